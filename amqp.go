@@ -3,17 +3,43 @@ package wfe
 import (
 	"bytes"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"github.com/pborman/uuid"
 	"github.com/streadway/amqp"
 	"net"
 	"net/url"
+	"strconv"
+	"sync"
 	"time"
 )
 
 const (
 	amqpContentType     = "application/wfe+message"
 	amqpContentEncoding = "encoding/gob"
+
+	//DefaultConfirmTimeout how long a dispatcher waits for the broker to confirm a message
+	DefaultConfirmTimeout = 30 * time.Second
+
+	amqpReconnectMin = 500 * time.Millisecond
+	amqpReconnectMax = 30 * time.Second
+)
+
+var (
+	//ErrNotConfirmed the broker didn't confirm a dispatched message in time
+	ErrNotConfirmed = errors.New("message is not confirmed by the broker")
+
+	//ErrRejected the broker refused a dispatched message
+	ErrRejected = errors.New("message is rejected by the broker")
+
+	//ErrUnroutable a dispatched message is not routed to any queue
+	ErrUnroutable = errors.New("message is not routed to any queue")
+
+	//ErrDisconnected the broker connection is lost and not recovered in time
+	ErrDisconnected = errors.New("broker is disconnected")
+
+	//ErrBrokerClosed the broker is closed
+	ErrBrokerClosed = errors.New("broker is closed")
 )
 
 type amqpDelivery struct {
@@ -28,112 +54,487 @@ func (r *amqpDelivery) Confirm() error {
 	return r.Delivery.Ack(false)
 }
 
-func (r *amqpDelivery) Content(c interface{}) error {
-	//un serialize the body and return a valid call
-	decoder := gob.NewDecoder(bytes.NewBuffer(r.Body))
-	if err := decoder.Decode(c); err != nil {
-		return err
+func (r *amqpDelivery) Requeue() error {
+	return r.Delivery.Nack(false, true)
+}
+
+//Redeliveries only quorum queues count the redeliveries (x-delivery-count header), it's always 0 on classic queues
+func (r *amqpDelivery) Redeliveries() int {
+	switch count := r.Headers["x-delivery-count"].(type) {
+	case int64:
+		return int(count)
+	case int32:
+		return int(count)
+	case int:
+		return count
 	}
 
-	return nil
+	return 0
+}
+
+func (r *amqpDelivery) Content(c interface{}) error {
+	return decodeContent(r.Body, c)
 }
 
 type amqpBroker struct {
-	con *amqp.Connection
-	//ctx     context.Context
-	invalid bool
+	url         string
+	dial        func(network, addr string) (net.Conn, error)
+	compression *compression
+	timeout     time.Duration
+	//queueArgs of the declared queues, x-max-priority if the queues are priority queues
+	queueArgs amqp.Table
+
+	m      sync.Mutex
+	con    *amqp.Connection
+	ready  chan struct{}
+	closed bool
+	//down is closed if the connection is lost and not recovered within the timeout
+	down     chan struct{}
+	downOnce sync.Once
 }
 
-type amqpDispatcher struct {
-	o  *RouteOptions
+//amqpPending is a published message waiting for its confirmation
+type amqpPending struct {
+	id   string
+	done chan error
+}
+
+//amqpPublisher is a dispatcher channel in confirm mode, a new one is opened if the channel is closed
+type amqpPublisher struct {
 	ch *amqp.Channel
+
+	//pub serializes the publishes, so the delivery tags follow the publish order
+	pub sync.Mutex
+	tag uint64
+
+	m        sync.Mutex
+	pending  map[uint64]*amqpPending
+	returned map[string]struct{}
+}
+
+type amqpDispatcher struct {
+	broker      *amqpBroker
+	compression *compression
+	timeout     time.Duration
+
+	m         sync.Mutex
+	publisher *amqpPublisher
+	closed    bool
 }
 
 type amqpConsumer struct {
-	o  *RouteOptions
-	ch *amqp.Channel
+	o      *RouteOptions
+	broker *amqpBroker
+
+	m      sync.Mutex
+	ch     *amqp.Channel
+	closed bool
 }
 
 func init() {
 	RegisterBroker("amqp", func(u *url.URL) (Broker, error) {
-		return NewAMQPBroker(u.String(), nil)
+		compression, err := parseCompression(u)
+		if err != nil {
+			return nil, err
+		}
+
+		q := u.Query()
+		timeout, err := parseInt(q.Get("confirm_timeout"), int(DefaultConfirmTimeout/time.Second))
+		if err != nil {
+			return nil, err
+		}
+
+		priority, err := parseInt(q.Get("max_priority"), 0)
+		if err != nil {
+			return nil, err
+		}
+
+		q.Del("confirm_timeout")
+		q.Del("max_priority")
+		u.RawQuery = q.Encode()
+
+		broker, err := NewAMQPBroker(u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		broker.(*amqpBroker).compression = compression
+		broker.(*amqpBroker).timeout = time.Duration(timeout) * time.Second
+		if priority > 0 {
+			//the queues must be declared with the same arguments by all the clients and workers
+			broker.(*amqpBroker).queueArgs = amqp.Table{"x-max-priority": int32(clampPriority(priority))}
+		}
+		return broker, nil
 	})
 }
 
+/*
+NewAMQPBroker connects to the amqp broker. The connection is recovered transparently if it's lost: the dispatchers
+wait for the connection (up to the confirm timeout) before failing with ErrDisconnected, and the consumers declare
+their queues again and resume consuming.
+*/
 func NewAMQPBroker(url string, Dial func(network, addr string) (net.Conn, error)) (Broker, error) {
-	var broker amqpBroker
-	if err := broker.init(url, Dial); err != nil {
+	broker := &amqpBroker{
+		url:     url,
+		dial:    Dial,
+		timeout: DefaultConfirmTimeout,
+		ready:   make(chan struct{}),
+		down:    make(chan struct{}),
+	}
+
+	con, err := broker.connect()
+	if err != nil {
 		return nil, err
 	}
-	return &broker, nil
+
+	broker.connected(con)
+	return broker, nil
 }
 
-func (b *amqpBroker) init(url string, Dial func(network, addr string) (net.Conn, error)) error {
-	c, err := amqp.DialConfig(url, amqp.Config{
+func (b *amqpBroker) connect() (*amqp.Connection, error) {
+	return amqp.DialConfig(b.url, amqp.Config{
 		Heartbeat: 10 * time.Second,
-		Dial:      Dial,
+		Dial:      b.dial,
 	})
+}
 
-	if err != nil {
-		return err
+//connected sets the broker connection and wakes up the routines waiting for it
+func (b *amqpBroker) connected(con *amqp.Connection) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if b.closed {
+		con.Close()
+		return
 	}
 
-	n := make(chan *amqp.Error)
-	c.NotifyClose(n)
-	go func() {
-		//defer close(n)
-		err := <-n
-		log.Errorf("Connection closed: %s", err)
-		b.invalid = true
-	}()
+	b.con = con
+	close(b.ready)
+	go b.watch(con)
+}
 
-	b.con = c
-	return nil
+//watch the connection and reconnect with a backoff when it's lost
+func (b *amqpBroker) watch(con *amqp.Connection) {
+	err := <-con.NotifyClose(make(chan *amqp.Error, 1))
+	if err == nil {
+		//closed by the broker Close
+		return
+	}
+
+	log.Errorf("Connection closed: %s", err)
+
+	b.m.Lock()
+	if b.closed {
+		b.m.Unlock()
+		return
+	}
+	b.con = nil
+	b.ready = make(chan struct{})
+	go b.expire(b.ready)
+	b.m.Unlock()
+
+	backoff := amqpReconnectMin
+	for {
+		con, err := b.connect()
+		if err == nil {
+			log.Infof("Reconnected to broker")
+			b.connected(con)
+			return
+		}
+
+		log.Errorf("Failed to reconnect to broker: %s", err)
+		time.Sleep(backoff)
+
+		b.m.Lock()
+		closed := b.closed
+		b.m.Unlock()
+		if closed {
+			return
+		}
+
+		if backoff *= 2; backoff > amqpReconnectMax {
+			backoff = amqpReconnectMax
+		}
+	}
 }
 
-func (b *amqpBroker) makeRoute(o *RouteOptions) (*amqp.Channel, error) {
+//expire marks the broker down if the connection is not recovered within the timeout
+func (b *amqpBroker) expire(ready chan struct{}) {
+	select {
+	case <-ready:
+	case <-time.After(b.timeout):
+		log.Errorf("Connection not recovered in %s", b.timeout)
+		b.downOnce.Do(func() {
+			close(b.down)
+		})
+	}
+}
+
+//Down returns a channel that is closed if the connection is lost and not recovered within the confirm timeout, so
+//the broker can be replaced by another node (see Options.Brokers)
+func (b *amqpBroker) Down() <-chan struct{} {
+	return b.down
+}
+
+//connection returns the broker connection, waiting up to timeout for the connection to recover, or until the broker
+//is closed if timeout is 0
+func (b *amqpBroker) connection(timeout time.Duration) (*amqp.Connection, error) {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		expired = time.After(timeout)
+	}
+
+	for {
+		b.m.Lock()
+		con, ready, closed := b.con, b.ready, b.closed
+		b.m.Unlock()
+
+		switch {
+		case closed:
+			return nil, ErrBrokerClosed
+		case con != nil:
+			return con, nil
+		}
+
+		select {
+		case <-ready:
+		case <-expired:
+			return nil, ErrDisconnected
+		}
+	}
+}
+
+//channel opens a new channel on the broker connection
+func (b *amqpBroker) channel(timeout time.Duration) (*amqp.Channel, error) {
+	con, err := b.connection(timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return con.Channel()
+}
+
+func (b *amqpBroker) makeRoute(o *RouteOptions, timeout time.Duration) (*amqp.Channel, error) {
 	//TODO: broker should remember the route options and reuse objects accordingly
-	ch, err := b.con.Channel()
+	ch, err := b.channel(timeout)
 	if err != nil {
 		return nil, err
 	}
 
-	if o != nil {
-		if _, err := ch.QueueDeclare(o.Queue, o.Durable, o.AutoDelete, o.Exclusive, false, nil); err != nil {
-			return nil, err
+	if err := declareRoute(ch, o, b.queueArgs); err != nil {
+		ch.Close()
+		return nil, err
+	}
+
+	return ch, nil
+}
+
+func declareRoute(ch *amqp.Channel, o *RouteOptions, args amqp.Table) error {
+	if o == nil {
+		return nil
+	}
+
+	if _, err := ch.QueueDeclare(o.Queue, o.Durable, o.AutoDelete, o.Exclusive, false, args); err != nil {
+		return err
+	}
+
+	if o.Exchange == "" {
+		return nil
+	}
+
+	if err := declareExchange(ch, o); err != nil {
+		return err
+	}
+
+	bindings := o.Bindings
+	if len(bindings) == 0 {
+		bindings = []string{o.Queue}
+	}
+
+	for _, key := range bindings {
+		if err := ch.QueueBind(o.Queue, key, o.Exchange, false, nil); err != nil {
+			return err
 		}
 	}
 
-	return ch, err
+	return nil
+}
+
+func declareExchange(ch *amqp.Channel, o *RouteOptions) error {
+	kind := o.ExchangeType
+	if kind == "" {
+		kind = amqp.ExchangeDirect
+	}
+
+	return ch.ExchangeDeclare(o.Exchange, kind, o.Durable, o.AutoDelete, false, false, nil)
 }
 
 func (b *amqpBroker) Consumer(o *RouteOptions) (Consumer, error) {
-	ch, err := b.makeRoute(o)
+	ch, err := b.makeRoute(o, b.timeout)
 	if err != nil {
 		return nil, err
 	}
+
 	return &amqpConsumer{
-		o:  o,
-		ch: ch,
+		o:      o,
+		broker: b,
+		ch:     ch,
 	}, nil
 }
 
+//Dispatcher returns a dispatcher that publishes in confirm mode, Dispatch only returns once the broker confirmed
+//the message is routed and stored
 func (b *amqpBroker) Dispatcher() (Dispatcher, error) {
-	ch, err := b.con.Channel()
-	if err != nil {
+	dispatcher := &amqpDispatcher{
+		broker:      b,
+		compression: b.compression,
+		timeout:     b.timeout,
+	}
+
+	if _, err := dispatcher.open(); err != nil {
 		return nil, err
 	}
-	return &amqpDispatcher{
-		ch: ch,
-	}, nil
+
+	return dispatcher, nil
+}
+
+//admin runs a queue administration command on its own channel, a missing queue closes the channel
+func (b *amqpBroker) admin(command func(ch *amqp.Channel) error) error {
+	ch, err := b.channel(b.timeout)
+	if err != nil {
+		return err
+	}
+
+	defer ch.Close()
+	return command(ch)
+}
+
+func (b *amqpBroker) QueueLength(queue string) (int, error) {
+	var length int
+	err := b.admin(func(ch *amqp.Channel) error {
+		q, err := ch.QueueInspect(queue)
+		length = q.Messages
+		return err
+	})
+
+	return length, err
+}
+
+func (b *amqpBroker) Purge(queue string) (int, error) {
+	var purged int
+	err := b.admin(func(ch *amqp.Channel) (err error) {
+		purged, err = ch.QueuePurge(queue, false)
+		return err
+	})
+
+	return purged, err
+}
+
+//ListQueues is not supported by the amqp protocol, the queues are listed by the RabbitMQ management api
+func (b *amqpBroker) ListQueues() ([]string, error) {
+	return nil, ErrNotSupported
+}
+
+func (b *amqpBroker) DeleteQueue(queue string) error {
+	return b.admin(func(ch *amqp.Channel) error {
+		_, err := ch.QueueDelete(queue, false, false, false)
+		return err
+	})
+}
+
+//Peek gets the messages without confirming them, they are requeued when the channel is closed
+func (b *amqpBroker) Peek(queue string, n int) ([]Request, error) {
+	var requests []Request
+	err := b.admin(func(ch *amqp.Channel) error {
+		for len(requests) < n {
+			msg, ok, err := ch.Get(queue, false)
+			if err != nil {
+				return err
+			} else if !ok {
+				return nil
+			}
+
+			if msg.ContentType != amqpContentType {
+				continue
+			}
+
+			var req requestImpl
+			if err := decodeContent(msg.Body, &req); err != nil {
+				return err
+			}
+			requests = append(requests, &req)
+		}
+
+		return nil
+	})
+
+	return requests, err
 }
 
 func (b *amqpBroker) Close() error {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if b.closed {
+		return nil
+	}
+
+	b.closed = true
+	if b.con == nil {
+		//wake up the routines waiting for the connection
+		close(b.ready)
+		return nil
+	}
+
 	return b.con.Close()
 }
 
-func (b *amqpDispatcher) makeRoute(o *RouteOptions) error {
-	if _, err := b.ch.QueueDeclare(o.Queue, o.Durable, o.AutoDelete, o.Exclusive, false, nil); err != nil {
+//open returns the dispatcher publisher, a new channel is opened if the previous one is closed
+func (b *amqpDispatcher) open() (*amqpPublisher, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if b.closed {
+		return nil, ErrBrokerClosed
+	}
+
+	if b.publisher != nil && !b.publisher.failed() {
+		return b.publisher, nil
+	}
+
+	ch, err := b.broker.channel(b.timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ch.Confirm(false); err != nil {
+		ch.Close()
+		return nil, err
+	}
+
+	publisher := &amqpPublisher{
+		ch:       ch,
+		pending:  make(map[uint64]*amqpPending),
+		returned: make(map[string]struct{}),
+	}
+
+	//the notifications are consumed by a single routine, a blocked listener would block the whole connection
+	go publisher.notify(
+		ch.NotifyPublish(make(chan amqp.Confirmation, 16)),
+		ch.NotifyReturn(make(chan amqp.Return, 16)),
+	)
+
+	b.publisher = publisher
+	return publisher, nil
+}
+
+func (p *amqpPublisher) makeRoute(o *RouteOptions, args amqp.Table) error {
+	if o.Exchange != "" {
+		//the queues are declared and bound by the consumers
+		return declareExchange(p.ch, o)
+	}
+
+	if _, err := p.ch.QueueDeclare(o.Queue, o.Durable, o.AutoDelete, o.Exclusive, false, args); err != nil {
 		return err
 	}
 
@@ -141,52 +542,295 @@ func (b *amqpDispatcher) makeRoute(o *RouteOptions) error {
 }
 
 func (b *amqpDispatcher) Dispatch(o *RouteOptions, msg *Message) (string, error) {
-	b.makeRoute(o)
+	id := uuid.New()
+	if err := b.DispatchID(o, msg, id); err != nil {
+		return "", err
+	}
 
+	return id, nil
+}
+
+//DispatchID publishes msg with the id as correlation id
+func (b *amqpDispatcher) DispatchID(o *RouteOptions, msg *Message, id string) error {
 	var buffer bytes.Buffer
 	encoder := gob.NewEncoder(&buffer)
 	if err := encoder.Encode(msg.Content); err != nil {
-		return "", err
+		return err
 	}
 
-	queue := o.Queue
-
-	if queue == "" {
-		return "", fmt.Errorf("queue is not set")
+	body, err := b.compression.compress(buffer.Bytes())
+	if err != nil {
+		return err
 	}
 
-	id := uuid.New()
+	key := o.RoutingKey
+	if o.Exchange == "" {
+		if o.Queue == "" {
+			return fmt.Errorf("queue is not set")
+		}
+		key = o.Queue
+	}
 
-	return id, b.ch.Publish("", queue, false, false, amqp.Publishing{
+	publishing := amqp.Publishing{
 		DeliveryMode:    amqp.Persistent,
 		ContentType:     amqpContentType,
 		ContentEncoding: amqpContentEncoding,
-		Body:            buffer.Bytes(),
+		Body:            body,
 		CorrelationId:   id,
-	})
+		Priority:        uint8(clampPriority(msg.Priority)),
+	}
+
+	if !msg.ExpiresAt.IsZero() {
+		ttl := time.Until(msg.ExpiresAt) / time.Millisecond
+		if ttl <= 0 {
+			return ErrExpired
+		}
+		publishing.Expiration = strconv.FormatInt(int64(ttl), 10)
+	}
+
+	var publisher *amqpPublisher
+	var tag uint64
+	var done <-chan error
+	//a channel closed by a lost connection is only noticed on publish, so retry once on a new channel
+	for attempt := 0; attempt < 2; attempt++ {
+		if publisher, err = b.open(); err != nil {
+			return err
+		}
+
+		if err = publisher.makeRoute(o, b.broker.queueArgs); err == nil {
+			tag, done, err = publisher.publish(o.Exchange, key, publishing)
+		}
+
+		if err == nil {
+			break
+		}
+
+		//a failed declare (for example a queue declared with other arguments) closes the channel too
+		publisher.fail()
+		if err != amqp.ErrClosed {
+			break
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return err
+		}
+	case <-time.After(b.timeout):
+		publisher.forget(tag)
+		return ErrNotConfirmed
+	}
+
+	return nil
 }
 
 func (b *amqpDispatcher) Close() error {
-	return b.ch.Close()
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	b.closed = true
+	if b.publisher == nil {
+		return nil
+	}
+
+	return b.publisher.ch.Close()
+}
+
+//publish a mandatory message and register it for the confirmation, the delivery tags are sequential per channel. The
+//message is registered before it's published so its confirmation can't be missed, and the notifications are not
+//blocked while the publish waits for the connection
+func (p *amqpPublisher) publish(exchange, key string, msg amqp.Publishing) (uint64, <-chan error, error) {
+	p.pub.Lock()
+	defer p.pub.Unlock()
+
+	pending := &amqpPending{
+		id:   msg.CorrelationId,
+		done: make(chan error, 1),
+	}
+
+	p.m.Lock()
+	if p.pending == nil {
+		p.m.Unlock()
+		return 0, nil, amqp.ErrClosed
+	}
+
+	tag := p.tag + 1
+	p.pending[tag] = pending
+	p.m.Unlock()
+
+	if err := p.ch.Publish(exchange, key, true, false, msg); err != nil {
+		p.forget(tag)
+		return 0, nil, err
+	}
+
+	p.tag = tag
+	return tag, pending.done, nil
 }
 
+//forget a message that is not waiting for its confirmation anymore
+func (p *amqpPublisher) forget(tag uint64) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	if pending, ok := p.pending[tag]; ok {
+		delete(p.pending, tag)
+		delete(p.returned, pending.id)
+	}
+}
+
+func (p *amqpPublisher) notify(confirms <-chan amqp.Confirmation, returns <-chan amqp.Return) {
+	for {
+		select {
+		case ret, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+
+			p.m.Lock()
+			if p.returned != nil {
+				p.returned[ret.CorrelationId] = struct{}{}
+			}
+			p.m.Unlock()
+		case confirm, ok := <-confirms:
+			if !ok {
+				p.fail()
+				return
+			}
+
+			p.m.Lock()
+			//a message is returned before it's confirmed
+			for drained := false; !drained; {
+				select {
+				case ret, ok := <-returns:
+					if ok && p.returned != nil {
+						p.returned[ret.CorrelationId] = struct{}{}
+					}
+					drained = !ok
+				default:
+					drained = true
+				}
+			}
+
+			if pending, ok := p.pending[confirm.DeliveryTag]; ok {
+				var err error
+				if _, returned := p.returned[pending.id]; returned {
+					err = ErrUnroutable
+				} else if !confirm.Ack {
+					err = ErrRejected
+				}
+
+				pending.done <- err
+				delete(p.pending, confirm.DeliveryTag)
+				delete(p.returned, pending.id)
+			}
+			p.m.Unlock()
+		}
+	}
+}
+
+//fail the messages waiting for a confirmation once the channel is closed
+func (p *amqpPublisher) fail() {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	for _, pending := range p.pending {
+		pending.done <- ErrNotConfirmed
+	}
+
+	p.pending = nil
+	p.returned = nil
+}
+
+func (p *amqpPublisher) failed() bool {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	return p.pending == nil
+}
+
+func (b *amqpConsumer) consume(ch *amqp.Channel) (<-chan amqp.Delivery, error) {
+	if b.o.Prefetch > 0 {
+		if err := ch.Qos(b.o.Prefetch, 0, false); err != nil {
+			return nil, err
+		}
+	}
+
+	return ch.Consume(b.o.Queue, "", b.o.AutoConfirm, b.o.Exclusive, false, false, nil)
+}
+
+//resubscribe declares the consumer route again on a new channel once the connection is recovered, and consumes it.
+//It returns false if the consumer (or the broker) is closed.
+func (b *amqpConsumer) resubscribe() (<-chan amqp.Delivery, bool) {
+	backoff := amqpReconnectMin
+	for {
+		b.m.Lock()
+		closed := b.closed
+		b.m.Unlock()
+		if closed {
+			return nil, false
+		}
+
+		log.Warningf("Consumer of queue '%s' lost its channel, subscribing again", b.o.Queue)
+		ch, err := b.broker.makeRoute(b.o, 0)
+		if err == ErrBrokerClosed {
+			return nil, false
+		}
+
+		var msges <-chan amqp.Delivery
+		if err == nil {
+			if msges, err = b.consume(ch); err == nil {
+				b.m.Lock()
+				defer b.m.Unlock()
+				if b.closed {
+					ch.Close()
+					return nil, false
+				}
+
+				b.ch = ch
+				return msges, true
+			}
+			ch.Close()
+		}
+
+		log.Errorf("Failed to consume queue '%s': %s", b.o.Queue, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > amqpReconnectMax {
+			backoff = amqpReconnectMax
+		}
+	}
+}
+
+//Consume the queue deliveries. If the channel is lost the queue is declared and consumed again once the connection
+//is recovered, the deliveries channel is only closed when the consumer (or the broker) is closed
 func (b *amqpConsumer) Consume() (<-chan Delivery, error) {
-	msges, err := b.ch.Consume(b.o.Queue, "", b.o.AutoConfirm, b.o.Exclusive, false, false, nil)
+	msges, err := b.consume(b.ch)
 	if err != nil {
 		return nil, err
 	}
+
 	feeder := make(chan Delivery)
 
 	go func() {
 		defer close(feeder)
-		for msg := range msges {
-			if msg.ContentType != amqpContentType {
-				log.Warningf("received a message with wrong content type '%s', ignoring.", msg.ContentType)
-				break
-			}
-
-			feeder <- &amqpDelivery{
-				Delivery: msg,
+		for ok := true; ok; msges, ok = b.resubscribe() {
+			for msg := range msges {
+				if msg.ContentType != amqpContentType {
+					log.Warningf("received a message with wrong content type '%s', ignoring.", msg.ContentType)
+					if !b.o.AutoConfirm {
+						msg.Reject(false)
+					}
+					continue
+				}
+
+				feeder <- &amqpDelivery{
+					Delivery: msg,
+				}
 			}
 		}
 	}()
@@ -195,5 +839,13 @@ func (b *amqpConsumer) Consume() (<-chan Delivery, error) {
 }
 
 func (b *amqpConsumer) Close() error {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	b.closed = true
+	if b.ch == nil {
+		return nil
+	}
+
 	return b.ch.Close()
 }
@@ -0,0 +1,101 @@
+package wfe
+
+import (
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestAMQPPublisherConfirm(t *testing.T) {
+	publisher := &amqpPublisher{
+		pending:  make(map[uint64]*amqpPending),
+		returned: make(map[string]struct{}),
+	}
+
+	var done []chan error
+	for i, id := range []string{"acked", "nacked", "returned", "closed"} {
+		pending := &amqpPending{id: id, done: make(chan error, 1)}
+		publisher.pending[uint64(i+1)] = pending
+		done = append(done, pending.done)
+	}
+
+	confirms := make(chan amqp.Confirmation, 4)
+	returns := make(chan amqp.Return, 4)
+
+	confirms <- amqp.Confirmation{DeliveryTag: 1, Ack: true}
+	confirms <- amqp.Confirmation{DeliveryTag: 2, Ack: false}
+	returns <- amqp.Return{CorrelationId: "returned"}
+	confirms <- amqp.Confirmation{DeliveryTag: 3, Ack: true}
+	close(confirms)
+
+	publisher.notify(confirms, returns)
+
+	for i, expected := range []error{nil, ErrRejected, ErrUnroutable, ErrNotConfirmed} {
+		if ok := assert.Equal(t, expected, <-done[i]); !ok {
+			t.Fatal()
+		}
+	}
+
+	if ok := assert.Nil(t, publisher.pending); !ok {
+		t.Fatal()
+	}
+}
+
+func TestAMQPPublisherForget(t *testing.T) {
+	publisher := &amqpPublisher{
+		pending:  map[uint64]*amqpPending{1: {id: "timeout", done: make(chan error, 1)}},
+		returned: map[string]struct{}{"timeout": {}},
+	}
+
+	//a message that is not confirmed in time doesn't leak
+	publisher.forget(1)
+	if ok := assert.Empty(t, publisher.pending); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Empty(t, publisher.returned); !ok {
+		t.Fatal()
+	}
+
+	//a late confirmation is ignored
+	confirms := make(chan amqp.Confirmation, 1)
+	confirms <- amqp.Confirmation{DeliveryTag: 1, Ack: true}
+	close(confirms)
+
+	publisher.notify(confirms, make(chan amqp.Return))
+	if ok := assert.True(t, publisher.failed()); !ok {
+		t.Fatal()
+	}
+}
+
+func TestAMQPBrokerDisconnected(t *testing.T) {
+	broker := &amqpBroker{
+		ready: make(chan struct{}),
+	}
+
+	_, err := broker.connection(10 * time.Millisecond)
+	if ok := assert.Equal(t, ErrDisconnected, err); !ok {
+		t.Fatal()
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := broker.connection(0)
+		done <- err
+	}()
+
+	if ok := assert.Nil(t, broker.Close()); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, ErrBrokerClosed, <-done); !ok {
+		t.Fatal()
+	}
+
+	dispatcher := &amqpDispatcher{broker: broker, timeout: time.Second}
+	_, err = dispatcher.Dispatch(WorkQueueRoute, &Message{Content: MustCall(wfeAddTest, 1, 2)})
+	if ok := assert.Equal(t, ErrBrokerClosed, err); !ok {
+		t.Fatal()
+	}
+}
@@ -0,0 +1,242 @@
+package wfe
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"io"
+	"time"
+)
+
+const (
+	//DefaultBlobThreshold payloads larger than this size (in bytes) are offloaded to the blob store
+	DefaultBlobThreshold = 1 << 20
+)
+
+var (
+	//ErrNoBlobStore the payload of a message is offloaded but no blob store is configured to load it
+	ErrNoBlobStore = errors.New("payload is offloaded but no blob store is configured")
+)
+
+/*
+BlobStore keeps the large payloads (arguments and results) out of the broker messages and the result store. The
+messages only carry the reference returned by Put. The interface maps to S3 compatible object stores, where the
+reference is the object key and the expiry is handled by a lifecycle rule.
+*/
+type BlobStore interface {
+	//Put stores the data until expires and returns its reference. A zero expires time uses the default keep period of
+	//the store.
+	Put(data []byte, expires time.Time) (string, error)
+
+	//Get loads the data of the reference
+	Get(ref string) ([]byte, error)
+
+	//Delete the data of the reference
+	Delete(ref string) error
+}
+
+//resultRetention is implemented by the result stores that expire the responses, so offloaded results expire with them
+type resultRetention interface {
+	retention() time.Duration
+}
+
+type requestPayload struct {
+	Arguments []interface{}
+	Keywords  map[string]interface{}
+}
+
+type resultPayload struct {
+	Result interface{}
+}
+
+//offloader moves the payloads above the threshold to the blob store, a nil offloader doesn't offload. The blobs are
+//sealed if a keyring is set, the blob store is not trusted more than the broker
+type offloader struct {
+	blobs     BlobStore
+	threshold int
+	keyring   *Keyring
+}
+
+func newOffloader(o *Options) (*offloader, error) {
+	blobs, err := o.GetBlobStore()
+	if err != nil || blobs == nil {
+		return nil, err
+	}
+
+	threshold := o.BlobThreshold
+	if threshold <= 0 {
+		threshold = DefaultBlobThreshold
+	}
+
+	return &offloader{
+		blobs:     blobs,
+		threshold: threshold,
+		keyring:   o.Keyring,
+	}, nil
+}
+
+//put stores v in the blob store if its encoding is larger than the threshold, otherwise it returns an empty reference.
+//v is sealed with the key id if a keyring is set
+func (o *offloader) put(v interface{}, key string, expires time.Time) (string, error) {
+	if o == nil {
+		return "", nil
+	}
+
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(v); err != nil {
+		return "", err
+	}
+
+	if buffer.Len() <= o.threshold {
+		return "", nil
+	}
+
+	if o.keyring != nil {
+		s, err := o.keyring.seal(key, "", v)
+		if err != nil {
+			return "", err
+		}
+
+		buffer.Reset()
+		if err := gob.NewEncoder(&buffer).Encode(s); err != nil {
+			return "", err
+		}
+	}
+
+	return o.blobs.Put(buffer.Bytes(), expires)
+}
+
+//keyID returns the key id the requests (or the results) are sealed with
+func (o *offloader) keyID(result bool) string {
+	if o == nil || o.keyring == nil {
+		return ""
+	}
+
+	if result {
+		return o.keyring.resultKeyID()
+	}
+
+	return o.keyring.KeyID
+}
+
+//delete the blob of the reference, once the payload is not needed anymore
+func (o *offloader) delete(ref string) error {
+	if o == nil {
+		return ErrNoBlobStore
+	}
+
+	return o.blobs.Delete(ref)
+}
+
+//close the blob store, if it holds resources
+func (o *offloader) close() error {
+	if o == nil {
+		return nil
+	}
+
+	if closer, ok := o.blobs.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+func (o *offloader) get(ref string, v interface{}) error {
+	if o == nil {
+		return ErrNoBlobStore
+	}
+
+	data, err := o.blobs.Get(ref)
+	if err != nil {
+		return err
+	}
+
+	if o.keyring == nil {
+		return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+	}
+
+	var s sealed
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&s); err != nil || s.Signature == nil {
+		return ErrUnsigned
+	}
+
+	return o.keyring.open(&s, v)
+}
+
+//request returns a copy of the request that references its offloaded arguments, or the request itself if they are
+//small enough
+func (o *offloader) request(req Request) (Request, error) {
+	r, ok := req.(*requestImpl)
+	if !ok || r.Blob != "" {
+		return req, nil
+	}
+
+	ref, err := o.put(&requestPayload{Arguments: r.Arguments, Keywords: r.Keywords}, o.keyID(false), time.Time{})
+	if err != nil || ref == "" {
+		return req, err
+	}
+
+	offloaded := *r
+	offloaded.Blob = ref
+	offloaded.Arguments = nil
+	offloaded.Keywords = nil
+
+	return &offloaded, nil
+}
+
+//loadRequest loads the offloaded arguments of the request
+func (o *offloader) loadRequest(r *requestImpl) error {
+	if r.Blob == "" {
+		return nil
+	}
+
+	var payload requestPayload
+	if err := o.get(r.Blob, &payload); err != nil {
+		return err
+	}
+
+	r.Arguments = payload.Arguments
+	r.Keywords = payload.Keywords
+	r.Blob = ""
+
+	return nil
+}
+
+//response offloads the result of the response, the blob expires with the response
+func (o *offloader) response(store ResultStore, response *Response) error {
+	if response.Result == nil {
+		return nil
+	}
+
+	var expires time.Time
+	if r, ok := store.(resultRetention); ok && r.retention() > 0 {
+		expires = time.Now().Add(r.retention())
+	}
+
+	ref, err := o.put(&resultPayload{Result: response.Result}, o.keyID(true), expires)
+	if err != nil || ref == "" {
+		return err
+	}
+
+	response.Blob = ref
+	response.Result = nil
+
+	return nil
+}
+
+//loadResponse loads the offloaded result of the response
+func (o *offloader) loadResponse(response *Response) error {
+	if response.Blob == "" {
+		return nil
+	}
+
+	var payload resultPayload
+	if err := o.get(response.Blob, &payload); err != nil {
+		return err
+	}
+
+	response.Result = payload.Result
+	response.Blob = ""
+
+	return nil
+}
@@ -0,0 +1,348 @@
+package wfe
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func blobTestStore(t *testing.T) (*fileBlobStore, func()) {
+	dir, err := ioutil.TempDir("", "wfe")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o := Options{
+		Blob: "file://" + dir,
+	}
+
+	store, err := o.GetBlobStore()
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	return store.(*fileBlobStore), func() {
+		store.(*fileBlobStore).Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestFileBlobStore(t *testing.T) {
+	store, done := blobTestStore(t)
+	defer done()
+
+	ref, err := store.Put([]byte("data"), time.Time{})
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	data, err := store.Get(ref)
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, []byte("data"), data); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Nil(t, store.Delete(ref)); !ok {
+		t.Fatal()
+	}
+
+	_, err = store.Get(ref)
+	if ok := assert.Error(t, err); !ok {
+		t.Fatal()
+	}
+
+	_, err = store.Get("../secret")
+	if ok := assert.Error(t, err); !ok {
+		t.Fatal()
+	}
+}
+
+func TestFileBlobStoreExpire(t *testing.T) {
+	store, done := blobTestStore(t)
+	defer done()
+
+	short, err := store.Put([]byte("short"), time.Now().Add(time.Second))
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	long, err := store.Put([]byte("long"), time.Time{})
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Nil(t, store.expire(time.Now().Add(time.Minute))); !ok {
+		t.Fatal()
+	}
+
+	_, err = store.Get(short)
+	if ok := assert.Error(t, err); !ok {
+		t.Fatal()
+	}
+
+	_, err = store.Get(long)
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+}
+
+func TestOffloadRequest(t *testing.T) {
+	store, done := blobTestStore(t)
+	defer done()
+
+	o := &offloader{blobs: store, threshold: 1024}
+
+	small := MustCall(wfeAddTest, 1, 2)
+	req, err := o.request(small)
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.True(t, small == req); !ok {
+		t.Fatal()
+	}
+
+	large := &requestImpl{
+		Function:  "large",
+		Arguments: []interface{}{strings.Repeat("x", 2048)},
+	}
+
+	req, err = o.request(large)
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	offloaded := req.(*requestImpl)
+	if ok := assert.NotEmpty(t, offloaded.Blob); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Nil(t, offloaded.Arguments); !ok {
+		t.Fatal()
+	}
+
+	//the caller request is not modified
+	if ok := assert.Len(t, large.Arguments, 1); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, ErrNoBlobStore, (*offloader)(nil).loadRequest(offloaded)); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Nil(t, o.loadRequest(offloaded)); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, large, offloaded); !ok {
+		t.Fatal()
+	}
+}
+
+func TestOffloadSealed(t *testing.T) {
+	store, done := blobTestStore(t)
+	defer done()
+
+	keyring := securityTestKeyring()
+	o := &offloader{blobs: store, threshold: 1024, keyring: keyring}
+
+	large := &requestImpl{
+		Function:  "large",
+		Arguments: []interface{}{strings.Repeat("x", 2048)},
+	}
+
+	req, err := o.request(large)
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	offloaded := *req.(*requestImpl)
+
+	//the blob is encrypted
+	data, err := store.Get(offloaded.Blob)
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.NotContains(t, string(data), "xxxx"); !ok {
+		t.Fatal()
+	}
+
+	//a tampered blob is rejected
+	tampered := append([]byte{}, data...)
+	tampered[len(tampered)/2] ^= 0xff
+	ref, err := store.Put(tampered, time.Time{})
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	r := offloaded
+	r.Blob = ref
+	if ok := assert.Equal(t, ErrInvalidSignature, o.loadRequest(&r)); !ok {
+		t.Fatal()
+	}
+
+	//and so is a blob that is not sealed
+	clear := &offloader{blobs: store, threshold: 1024}
+	req, err = clear.request(large)
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, ErrUnsigned, o.loadRequest(req.(*requestImpl))); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Nil(t, o.loadRequest(&offloaded)); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, large.Arguments, offloaded.Arguments); !ok {
+		t.Fatal()
+	}
+}
+
+func TestOffloadResponse(t *testing.T) {
+	store, done := blobTestStore(t)
+	defer done()
+
+	o := &offloader{blobs: store, threshold: 1024}
+
+	result := strings.Repeat("x", 2048)
+	response := &Response{UUID: "1234", State: StateSuccess, Result: result}
+	if ok := assert.Nil(t, o.response(&testStore{}, response)); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Nil(t, response.Result); !ok {
+		t.Fatal()
+	}
+
+	res := resultImpl{
+		id:    "1234",
+		store: &testStore{},
+		blobs: o,
+	}
+	res.store.(*testStore).On("Get", "1234", DefaultTimeout).Return(response, nil)
+
+	v, err := res.Get()
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, result, v); !ok {
+		t.Fatal()
+	}
+}
+
+func TestFileBlobStoreSharedCleaner(t *testing.T) {
+	store, done := blobTestStore(t)
+	defer done()
+
+	other, err := NewFileBlobStore(store.dir, 60)
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	//the stores of a directory share a single cleanup
+	if ok := assert.True(t, store.cleaner == other.(*fileBlobStore).cleaner); !ok {
+		t.Fatal()
+	}
+
+	//closing twice only releases the cleaner once
+	other.(*fileBlobStore).Close()
+	other.(*fileBlobStore).Close()
+
+	if ok := assert.Equal(t, 1, store.cleaner.refs); !ok {
+		t.Fatal()
+	}
+
+	store.Close()
+	select {
+	case <-store.cleaner.done:
+	default:
+		t.Fatal("the cleaner is not stopped")
+	}
+}
+
+func blobAddTest(c *Context, a, b int) int {
+	return a + b
+}
+
+func TestHandleDeliveryDeletesArguments(t *testing.T) {
+	Register(blobAddTest)
+	blobs, done := blobTestStore(t)
+	defer done()
+
+	o := &offloader{blobs: blobs, threshold: 16}
+	req, err := o.request(MustCall(blobAddTest, 1, 2))
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	ref := req.(*requestImpl).Blob
+	if ok := assert.NotEmpty(t, ref); !ok {
+		t.Fatal()
+	}
+
+	store := &testStore{}
+	eng := &Engine{store: store, blobs: o}
+
+	d := testDelivery{val: *req.(*requestImpl)}
+	d.On("ID").Return("1234")
+	d.On("Confirm").Return(nil)
+	store.On("Set", mock.MatchedBy(func(r *Response) bool {
+		return r.State == StateSuccess
+	})).Return(nil)
+
+	if ok := assert.Nil(t, eng.handleDelivery(&d)); !ok {
+		t.Fatal()
+	}
+
+	//the arguments are not needed once the message is confirmed
+	_, err = blobs.Get(ref)
+	if ok := assert.True(t, os.IsNotExist(err)); !ok {
+		t.Fatal()
+	}
+}
+
+func TestClientForgetBlob(t *testing.T) {
+	blobs, done := blobTestStore(t)
+	defer done()
+
+	store, closeStore := boltTestStore(t, "")
+	defer closeStore()
+
+	o := &offloader{blobs: blobs, threshold: 16}
+	response := &Response{UUID: "1234", State: StateSuccess, Result: strings.Repeat("x", 32)}
+	if ok := assert.Nil(t, o.response(store, response)); !ok {
+		t.Fatal()
+	}
+
+	ref := response.Blob
+	if ok := assert.Nil(t, store.Set(response)); !ok {
+		t.Fatal()
+	}
+
+	client := &clientImpl{store: store, blobs: o}
+	if ok := assert.Nil(t, client.Forget("1234")); !ok {
+		t.Fatal()
+	}
+
+	_, err := blobs.Get(ref)
+	if ok := assert.True(t, os.IsNotExist(err)); !ok {
+		t.Fatal()
+	}
+
+	_, err = Peek(store, "1234")
+	if ok := assert.Equal(t, ErrNotFound, err); !ok {
+		t.Fatal()
+	}
+}
@@ -0,0 +1,517 @@
+package wfe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"go.etcd.io/bbolt"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	boltCleanupInterval = time.Minute
+	boltOpenTimeout     = 3 * time.Second
+)
+
+var (
+	boltResultsBucket  = []byte("results")
+	boltExpiryBucket   = []byte("expiry")
+	boltProgressBucket = []byte("progress")
+
+	//keys of the task buckets in the progress bucket, emitted values are keyed by the prefix and a sequence
+	boltProgressKey = []byte("p")
+	boltExpiresKey  = []byte("x")
+	boltEmitPrefix  = byte('e')
+
+	boltDBs = make(map[string]*boltDB)
+	bdm     sync.Mutex
+)
+
+//boltDB is a bolt database shared by all the stores of the process opened on the same file, since a bolt file can
+//only be opened once. The waiters are shared too, so a response stored by a worker wakes up the clients.
+type boltDB struct {
+	*bbolt.DB
+	path string
+	refs int
+
+	waiters resultWaiters
+}
+
+type boltStore struct {
+	db      *boltDB
+	timeout int
+	keep    int
+
+	done  chan struct{}
+	close sync.Once
+}
+
+func init() {
+	//bolt:///absolute/path.db or bolt://relative/path.db
+	RegisterResultStore("bolt", func(u *url.URL) (ResultStore, error) {
+		timeout, err := parseInt(u.Query().Get("timeout"), 30)
+		if err != nil {
+			return nil, err
+		}
+		keep, err := parseInt(u.Query().Get("keep"), 3600)
+		if err != nil {
+			return nil, err
+		}
+
+		return NewBoltStore(u.Host+u.Path, timeout, keep)
+	})
+}
+
+/*
+NewBoltStore creates a result store embedded in a bolt database file, so no external service is needed to keep
+the tasks results. Responses are kept for `keep` seconds (forever if keep is 0).
+
+Note that a bolt file can only be opened by a single process, so the clients waiting for results must run in the same
+process as the workers. The stores of a process opened on the same file share the database.
+
+	bolt:///var/lib/wfe/results.db?keep=3600&timeout=30
+*/
+func NewBoltStore(path string, timeout int, keep int) (ResultStore, error) {
+	db, err := openBoltDB(path)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &boltStore{
+		db:      db,
+		timeout: timeout,
+		keep:    keep,
+		done:    make(chan struct{}),
+	}
+
+	if keep > 0 {
+		go store.cleanup()
+	}
+
+	return store, nil
+}
+
+//openBoltDB opens the bolt database of the path, or returns the database already opened by another store
+func openBoltDB(path string) (*boltDB, error) {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+
+	bdm.Lock()
+	defer bdm.Unlock()
+
+	if db, ok := boltDBs[path]; ok {
+		db.refs++
+		return db, nil
+	}
+
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: boltOpenTimeout})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{boltResultsBucket, boltExpiryBucket, boltProgressBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	shared := &boltDB{DB: db, path: path, refs: 1}
+	boltDBs[path] = shared
+	return shared, nil
+}
+
+//release closes the database when the last store using it is closed
+func (db *boltDB) release() error {
+	bdm.Lock()
+	defer bdm.Unlock()
+
+	db.refs--
+	if db.refs > 0 {
+		return nil
+	}
+
+	delete(boltDBs, db.path)
+	return db.DB.Close()
+}
+
+//boltExpiryKey is the expiry index key, expiry time first so the index is sorted by time
+func boltExpiryKey(expires int64, id string) []byte {
+	key := make([]byte, 8, 8+len(id))
+	binary.BigEndian.PutUint64(key, uint64(expires))
+	return append(key, id...)
+}
+
+func (s *boltStore) Set(response *Response) error {
+	var buffer bytes.Buffer
+	//value is the expiry time (0 for never) followed by the encoded response
+	var expires int64
+	if s.keep > 0 {
+		expires = time.Now().Add(time.Duration(s.keep) * time.Second).UnixNano()
+	}
+	binary.Write(&buffer, binary.BigEndian, expires)
+
+	enc := gob.NewEncoder(&buffer)
+	if err := enc.Encode(response); err != nil {
+		return err
+	}
+
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		results := tx.Bucket(boltResultsBucket)
+		expiry := tx.Bucket(boltExpiryBucket)
+
+		id := []byte(response.UUID)
+		if old := results.Get(id); len(old) >= 8 {
+			if err := expiry.Delete(boltExpiryKey(int64(binary.BigEndian.Uint64(old)), response.UUID)); err != nil {
+				return err
+			}
+		}
+
+		if expires > 0 {
+			if err := expiry.Put(boltExpiryKey(expires, response.UUID), nil); err != nil {
+				return err
+			}
+		}
+
+		return results.Put(id, buffer.Bytes())
+	})
+
+	if err != nil {
+		return err
+	}
+
+	s.db.waiters.notify(response.UUID)
+	return nil
+}
+
+func (s *boltStore) retention() time.Duration {
+	return time.Duration(s.keep) * time.Second
+}
+
+//boltDecode decodes a stored value, it returns a nil response if the value is expired
+func boltDecode(data []byte, now int64) (*Response, error) {
+	if len(data) < 8 {
+		return nil, nil
+	}
+
+	expires := int64(binary.BigEndian.Uint64(data))
+	if expires > 0 && expires < now {
+		return nil, nil
+	}
+
+	response := &Response{}
+	//data is only valid during the transaction, the decoder copies what it needs
+	if err := gob.NewDecoder(bytes.NewReader(data[8:])).Decode(response); err != nil {
+		return nil, err
+	}
+
+	return response, nil
+}
+
+//load reads the responses of the ids, a response is nil if it's not available
+func (s *boltStore) load(ids ...string) ([]*Response, error) {
+	responses := make([]*Response, len(ids))
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		results := tx.Bucket(boltResultsBucket)
+		now := time.Now().UnixNano()
+		for i, id := range ids {
+			response, err := boltDecode(results.Get([]byte(id)), now)
+			if err != nil {
+				return err
+			}
+			responses[i] = response
+		}
+		return nil
+	})
+
+	return responses, err
+}
+
+func (s *boltStore) Peek(id string) (*Response, error) {
+	responses, err := s.load(id)
+	if err != nil {
+		return nil, err
+	} else if responses[0] == nil {
+		return nil, ErrNotFound
+	}
+
+	return responses[0], nil
+}
+
+func (s *boltStore) Forget(id string) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		if err := tx.Bucket(boltProgressBucket).DeleteBucket([]byte(id)); err != nil && err != bbolt.ErrBucketNotFound {
+			return err
+		}
+
+		results := tx.Bucket(boltResultsBucket)
+		if old := results.Get([]byte(id)); len(old) >= 8 {
+			expires := int64(binary.BigEndian.Uint64(old))
+			if err := tx.Bucket(boltExpiryBucket).Delete(boltExpiryKey(expires, id)); err != nil {
+				return err
+			}
+		}
+
+		return results.Delete([]byte(id))
+	})
+}
+
+func (s *boltStore) List(filter ResultFilter) ([]*Response, error) {
+	var responses []*Response
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		now := time.Now().UnixNano()
+		return tx.Bucket(boltResultsBucket).ForEach(func(k, v []byte) error {
+			if filter.Limit > 0 && len(responses) >= filter.Limit {
+				return nil
+			}
+
+			response, err := boltDecode(v, now)
+			if err != nil {
+				return err
+			}
+
+			if response != nil && filter.match(response) {
+				responses = append(responses, response)
+			}
+			return nil
+		})
+	})
+
+	return responses, err
+}
+
+func (s *boltStore) Get(id string, timeout int) (*Response, error) {
+	responses, err := s.GetMany([]string{id}, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return responses[0], nil
+}
+
+func (s *boltStore) GetMany(ids []string, timeout int) ([]*Response, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	if timeout == DefaultTimeout {
+		timeout = s.timeout
+	}
+
+	//timeout 0 blocks forever, same as redis
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(time.Duration(timeout) * time.Second)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	wake, cancel := s.db.waiters.wait(ids...)
+	defer cancel()
+
+	for {
+		responses, err := s.load(ids...)
+		if err != nil {
+			return nil, err
+		}
+
+		if available(responses) {
+			return responses, nil
+		}
+
+		select {
+		case <-wake:
+		case <-deadline:
+			return nil, ErrTimeout
+		}
+	}
+}
+
+//cleanup deletes the expired responses periodically
+func (s *boltStore) cleanup() {
+	interval := boltCleanupInterval
+	if keep := time.Duration(s.keep) * time.Second; keep < interval {
+		interval = keep
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.expire(time.Now()); err != nil {
+				log.Errorf("Failed to delete expired results: %s", err)
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *boltStore) expire(now time.Time) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		results := tx.Bucket(boltResultsBucket)
+		expiry := tx.Bucket(boltExpiryBucket)
+
+		limit := boltExpiryKey(now.UnixNano(), "")
+		var keys [][]byte
+		c := expiry.Cursor()
+		for k, _ := c.First(); k != nil && bytes.Compare(k[:8], limit) <= 0; k, _ = c.Next() {
+			keys = append(keys, append([]byte(nil), k...))
+		}
+
+		for _, k := range keys {
+			if err := results.Delete(k[8:]); err != nil {
+				return err
+			}
+			if err := expiry.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		//the progress buckets are few, one per running (or recent) task
+		progress := tx.Bucket(boltProgressBucket)
+		var ids [][]byte
+		err := progress.ForEach(func(k, v []byte) error {
+			expires := progress.Bucket(k).Get(boltExpiresKey)
+			if len(expires) == 8 && int64(binary.BigEndian.Uint64(expires)) < now.UnixNano() {
+				ids = append(ids, append([]byte(nil), k...))
+			}
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			if err := progress.DeleteBucket(id); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+//updateTask runs fn on the progress bucket of the task and refreshes its expiry time
+func (s *boltStore) updateTask(id string, fn func(b *bbolt.Bucket) error) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.Bucket(boltProgressBucket).CreateBucketIfNotExists([]byte(id))
+		if err != nil {
+			return err
+		}
+
+		if s.keep > 0 {
+			expires := make([]byte, 8)
+			binary.BigEndian.PutUint64(expires, uint64(time.Now().Add(time.Duration(s.keep)*time.Second).UnixNano()))
+			if err := b.Put(boltExpiresKey, expires); err != nil {
+				return err
+			}
+		}
+
+		return fn(b)
+	})
+}
+
+func (s *boltStore) SetProgress(id string, progress *Progress) error {
+	data, err := encodeProgress(progress)
+	if err != nil {
+		return err
+	}
+
+	return s.updateTask(id, func(b *bbolt.Bucket) error {
+		return b.Put(boltProgressKey, data)
+	})
+}
+
+func (s *boltStore) GetProgress(id string) (*Progress, error) {
+	var progress *Progress
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(boltProgressBucket).Bucket([]byte(id))
+		if b == nil {
+			return ErrNotFound
+		}
+
+		data := b.Get(boltProgressKey)
+		if data == nil {
+			return ErrNotFound
+		}
+
+		var err error
+		progress, err = decodeProgress(data)
+		return err
+	})
+
+	return progress, err
+}
+
+func boltEmitKey(seq uint64) []byte {
+	key := make([]byte, 9)
+	key[0] = boltEmitPrefix
+	binary.BigEndian.PutUint64(key[1:], seq)
+	return key
+}
+
+func (s *boltStore) Emit(id string, value interface{}) error {
+	data, err := encodeProgress(&streamValue{Value: value})
+	if err != nil {
+		return err
+	}
+
+	return s.updateTask(id, func(b *bbolt.Bucket) error {
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		return b.Put(boltEmitKey(seq), data)
+	})
+}
+
+func (s *boltStore) Emitted(id string, offset int) ([]interface{}, error) {
+	var values []interface{}
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(boltProgressBucket).Bucket([]byte(id))
+		if b == nil {
+			return nil
+		}
+
+		//sequences start at 1
+		c := b.Cursor()
+		for k, v := c.Seek(boltEmitKey(uint64(offset) + 1)); k != nil && k[0] == boltEmitPrefix; k, v = c.Next() {
+			value, err := decodeStreamValue(v)
+			if err != nil {
+				return err
+			}
+			values = append(values, value)
+		}
+
+		return nil
+	})
+
+	return values, err
+}
+
+//Close the store, the bolt database is closed with the last store of the file
+func (s *boltStore) Close() error {
+	var err error
+	s.close.Do(func() {
+		close(s.done)
+		err = s.db.release()
+	})
+
+	return err
+}
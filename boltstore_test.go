@@ -0,0 +1,229 @@
+package wfe
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/bbolt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func boltTestStore(t *testing.T, params string) (*boltStore, func()) {
+	dir, err := ioutil.TempDir("", "wfe")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o := Options{
+		Store: fmt.Sprintf("bolt://%s?%s", filepath.Join(dir, "results.db"), params),
+	}
+
+	store, err := o.GetStore()
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	return store.(*boltStore), func() {
+		store.(*boltStore).Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestBoltStoreSetGet(t *testing.T) {
+	store, done := boltTestStore(t, "")
+	defer done()
+
+	r := &Response{
+		UUID:   "1234",
+		State:  StateSuccess,
+		Error:  "error",
+		Result: 123,
+	}
+
+	if ok := assert.Nil(t, store.Set(r)); !ok {
+		t.Fatal()
+	}
+
+	resp, err := store.Get("1234", DefaultTimeout)
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, r, resp); !ok {
+		t.Fatal()
+	}
+}
+
+func TestBoltStoreGetWait(t *testing.T) {
+	store, done := boltTestStore(t, "")
+	defer done()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := store.Get("1234", 5)
+			if ok := assert.Nil(t, err); ok {
+				assert.Equal(t, 1, resp.Result)
+			}
+		}()
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if ok := assert.Nil(t, store.Set(&Response{UUID: "1234", State: StateSuccess, Result: 1})); !ok {
+		t.Fatal()
+	}
+
+	wg.Wait()
+}
+
+func TestBoltStoreGetTimeout(t *testing.T) {
+	store, done := boltTestStore(t, "timeout=1")
+	defer done()
+
+	_, err := store.Get("does not exist", DefaultTimeout)
+	if ok := assert.Equal(t, ErrTimeout, err); !ok {
+		t.Fatal()
+	}
+}
+
+func TestBoltStoreExpire(t *testing.T) {
+	store, done := boltTestStore(t, "")
+	defer done()
+
+	//same database, without the cleanup
+	expiring := &boltStore{db: store.db, keep: 1}
+	if ok := assert.Nil(t, expiring.Set(&Response{UUID: "1234", State: StateSuccess})); !ok {
+		t.Fatal()
+	}
+
+	_, err := store.Get("1234", 1)
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	stored := func() bool {
+		var data []byte
+		store.db.View(func(tx *bbolt.Tx) error {
+			data = tx.Bucket(boltResultsBucket).Get([]byte("1234"))
+			return nil
+		})
+		return data != nil
+	}
+
+	//expired responses are not returned, even before the cleanup
+	time.Sleep(1100 * time.Millisecond)
+	if ok := assert.True(t, stored()); !ok {
+		t.Fatal()
+	}
+
+	_, err = store.Peek("1234")
+	if ok := assert.Equal(t, ErrNotFound, err); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Nil(t, store.expire(time.Now())); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.False(t, stored()); !ok {
+		t.Fatal()
+	}
+}
+
+func TestBoltStoreSharedDB(t *testing.T) {
+	store, done := boltTestStore(t, "")
+	defer done()
+
+	//a second store on the same file doesn't wait for the file lock
+	other, err := NewBoltStore(store.db.path, 1, 0)
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, store.db, other.(*boltStore).db); !ok {
+		t.Fatal()
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		store.Set(&Response{UUID: "1234", State: StateSuccess, Result: 1})
+	}()
+
+	//woken up by the response stored by the other store
+	ts := time.Now()
+	resp, err := other.Get("1234", 1)
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, 1, resp.Result); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.True(t, time.Since(ts) < 500*time.Millisecond); !ok {
+		t.Fatal()
+	}
+
+	//the database is kept open until the last store is closed
+	if ok := assert.Nil(t, other.(*boltStore).Close()); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Nil(t, store.Set(&Response{UUID: "5678", State: StateSuccess})); !ok {
+		t.Fatal()
+	}
+}
+
+func TestBoltStoreManage(t *testing.T) {
+	store, done := boltTestStore(t, "")
+	defer done()
+
+	for i, state := range []string{StateSuccess, StateError, StateSuccess} {
+		r := &Response{UUID: fmt.Sprintf("id-%d", i), ParentUUID: "parent", State: state}
+		if ok := assert.Nil(t, store.Set(r)); !ok {
+			t.Fatal()
+		}
+	}
+
+	resps, err := store.GetMany([]string{"id-2", "id-0"}, 1)
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, "id-2", resps[0].UUID); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, "id-0", resps[1].UUID); !ok {
+		t.Fatal()
+	}
+
+	resps, err = store.List(ResultFilter{State: StateSuccess, ParentID: "parent"})
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Len(t, resps, 2); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Nil(t, store.Forget("id-1")); !ok {
+		t.Fatal()
+	}
+
+	_, err = store.Peek("id-1")
+	if ok := assert.Equal(t, ErrNotFound, err); !ok {
+		t.Fatal()
+	}
+
+	_, err = store.GetMany([]string{"id-0", "id-1"}, 1)
+	if ok := assert.Equal(t, ErrTimeout, err); !ok {
+		t.Fatal()
+	}
+}
@@ -1,5 +1,11 @@
 package wfe
 
+import (
+	"bytes"
+	"encoding/gob"
+	"time"
+)
+
 const (
 	DefaultQueueName = "wfe.default.work"
 )
@@ -24,6 +30,62 @@ type RouteOptions struct {
 	Exclusive bool
 	//AutoConfirm flag (for brokers that implements delivery confirmation
 	AutoConfirm bool
+	//Prefetch maximum number of unconfirmed deliveries a consumer holds (for brokers that support it), 0 for no limit
+	Prefetch int
+
+	//Exchange the messages are published to, or the queue is bound to (for brokers that support exchanges). If empty
+	//the messages are sent directly to the Queue
+	Exchange string
+	//ExchangeType of the exchange, `direct` (default), `fanout`, `topic` or `headers`
+	ExchangeType string
+	//RoutingKey of the published messages. Defaults to the queue name if no exchange is set
+	RoutingKey string
+	//Bindings keys (or topic patterns) the consumer queue is bound to the exchange with. Defaults to the queue name
+	Bindings []string
+
+	//Queues extra queues consumed by the consumer, after Queue (for brokers that can consume many queues at once)
+	Queues []string
+	//Job delivery options of the dispatched messages (for brokers that support them), nil for the broker defaults
+	Job *JobOptions
+}
+
+//JobOptions delivery options of the messages, for brokers that support them (disque). Zero values keep the defaults
+type JobOptions struct {
+	//Retry delay after which a message that is not confirmed is delivered again
+	Retry time.Duration
+	//Delay before the message can be delivered
+	Delay time.Duration
+	//TTL of the message, it's dropped once expired even if it's not delivered
+	TTL time.Duration
+	//MaxLen of the queue, the message is refused if the queue is longer
+	MaxLen int
+	//Replicate the message to at least this number of nodes
+	Replicate int
+}
+
+//merge returns the options overridden by the non zero values of o
+func (j JobOptions) merge(o *JobOptions) JobOptions {
+	if o == nil {
+		return j
+	}
+
+	if o.Retry > 0 {
+		j.Retry = o.Retry
+	}
+	if o.Delay > 0 {
+		j.Delay = o.Delay
+	}
+	if o.TTL > 0 {
+		j.TTL = o.TTL
+	}
+	if o.MaxLen > 0 {
+		j.MaxLen = o.MaxLen
+	}
+	if o.Replicate > 0 {
+		j.Replicate = o.Replicate
+	}
+
+	return j
 }
 
 //Broker interface
@@ -41,6 +103,21 @@ type Broker interface {
 //Message content
 type Message struct {
 	Content interface{}
+	//Priority of the message, from 0 (default) to MaxPriority, for brokers that support priorities
+	Priority int
+	//ExpiresAt time after which the message is dropped, for brokers that support it. Zero if it never expires
+	ExpiresAt time.Time
+}
+
+//decodeContent decompresses and decodes a message body
+func decodeContent(body []byte, c interface{}) error {
+	data, err := decompress(body)
+	if err != nil {
+		return err
+	}
+
+	//un serialize the body and return a valid call
+	return gob.NewDecoder(bytes.NewBuffer(data)).Decode(c)
 }
 
 //Dispatcher interface
@@ -52,6 +129,13 @@ type Dispatcher interface {
 	Dispatch(o *RouteOptions, msg *Message) (string, error)
 }
 
+//IDDispatcher is implemented by the dispatchers that can publish a message under an id chosen by the caller, so the id
+//can be sealed with the request
+type IDDispatcher interface {
+	//DispatchID dispatches msg under the given id
+	DispatchID(o *RouteOptions, msg *Message, id string) error
+}
+
 //Consumer interfaec
 type Consumer interface {
 	//Close consumer
@@ -80,3 +164,48 @@ type Delivery interface {
 	*/
 	Content(c interface{}) error
 }
+
+//Requeuer is implemented by deliveries that can be put back on the queue, so another consumer can process them.
+type Requeuer interface {
+	//Requeue the delivery instead of confirming it
+	Requeue() error
+}
+
+//Redeliverer is implemented by deliveries that know how many times they were put back on the queue, so a requeued
+//request is given up after Options.RequeueLimit redeliveries
+type Redeliverer interface {
+	//Redeliveries number of times the delivery was requeued before
+	Redeliveries() int
+}
+
+//DownNotifier is implemented by the brokers that can tell their node is lost for good, so the failover broker
+//(see Options.Brokers) switches to another node
+type DownNotifier interface {
+	//Down returns a channel that is closed once the broker node is lost
+	Down() <-chan struct{}
+}
+
+/*
+Admin is implemented by the brokers that can inspect and manage their queues, for example to scale the workers on
+the queue length, or to assert on the queue contents in tests.
+
+	if admin, ok := broker.(wfe.Admin); ok {
+		n, err := admin.QueueLength(wfe.DefaultQueueName)
+	}
+*/
+type Admin interface {
+	//QueueLength number of messages waiting on the queue, the unconfirmed deliveries excluded
+	QueueLength(queue string) (int, error)
+
+	//Purge drops the messages waiting on the queue and returns how many were dropped
+	Purge(queue string) (int, error)
+
+	//ListQueues lists the queue names, it fails with ErrNotSupported if the broker can't list its queues
+	ListQueues() ([]string, error)
+
+	//DeleteQueue deletes the queue and its messages
+	DeleteQueue(queue string) error
+
+	//Peek returns the next n requests waiting on the queue without consuming them
+	Peek(queue string, n int) ([]Request, error)
+}
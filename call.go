@@ -5,7 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
-	"runtime"
+	"time"
 )
 
 const (
@@ -14,6 +14,9 @@ const (
 
 	//StateError notates tasks has exited with an error
 	StateError = "error"
+
+	//StateExpired notates tasks that expired before they were run
+	StateExpired = "expired"
 )
 
 var (
@@ -22,6 +25,9 @@ var (
 
 	//ErrTooManyArguments task expecting fewer arguments than provided.
 	ErrTooManyArguments = errors.New("call with too many arguments")
+
+	//ErrVersionMismatch the worker doesn't implement the requested task version.
+	ErrVersionMismatch = errors.New("task version mismatch")
 )
 
 func init() {
@@ -32,12 +38,51 @@ func init() {
 type Response struct {
 	//UUID request UUID
 	UUID string
-	//Exit state of task execution (StateSuccess, StateError)
+	//ParentUUID UUID of the task that applied the request, if any
+	ParentUUID string
+	//Exit state of task execution (StateSuccess, StateError, StateExpired)
 	State string
 	//Error message if State != StateSuccess
 	Error string
+	//ErrorType type name of the error raised by the task if State != StateSuccess
+	ErrorType string
+	//ErrorCode optional error code if State != StateSuccess
+	ErrorCode string
+	//Retryable notates that the failed task may succeed if it's called again
+	Retryable bool
+	//Stack trace captured if the task paniced
+	Stack string
 	//Result object returned by the task
 	Result interface{}
+	//Blob reference of the result if it's offloaded to the blob store
+	Blob string
+	//Seal signed (and encrypted) response details if a Keyring is used
+	Seal *sealed
+}
+
+//SetError marks the response as failed and records the error details
+func (r *Response) SetError(err *TaskError) {
+	r.State = StateError
+	r.Error = err.Message
+	r.ErrorType = err.Type
+	r.ErrorCode = err.Code
+	r.Retryable = err.Retryable
+	r.Stack = err.Stack
+}
+
+//Err returns a *TaskError if State == StateError or StateExpired, or nil otherwise
+func (r *Response) Err() error {
+	if r.State != StateError && r.State != StateExpired {
+		return nil
+	}
+
+	return &TaskError{
+		Type:      r.ErrorType,
+		Code:      r.ErrorCode,
+		Message:   r.Error,
+		Retryable: r.Retryable,
+		Stack:     r.Stack,
+	}
 }
 
 type ParentIDSetter interface {
@@ -64,7 +109,41 @@ type PartialRequest interface {
 type requestImpl struct {
 	ParentUUID string
 	Function   string
+	Version    string
+	Key        string
 	Arguments  []interface{}
+	Keywords   map[string]interface{}
+	//ExpiresAt time after which the request is not run, zero if it never expires
+	ExpiresAt time.Time
+	//Priority overrides the priority of the task, nil for the task priority
+	Priority *int
+	//Blob reference of the arguments if they are offloaded to the blob store
+	Blob string
+	//Seal signed (and encrypted) request if a Keyring is used, the other fields are empty
+	Seal *sealed
+	//RoutingKey overrides the routing key of the task, empty for the task routing key
+	RoutingKey string
+}
+
+//CallOption sets optional attributes of a request, see With
+type CallOption func(r *requestImpl)
+
+/*
+With applies call options to a request created by Call, PartialCall or CallKw
+
+	req := wfe.With(wfe.MustCall(Charge, order.ID), wfe.IdempotencyKey(order.ID))
+*/
+func With(req Request, opts ...CallOption) Request {
+	r, ok := req.(*requestImpl)
+	if !ok {
+		return req
+	}
+
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	return r
 }
 
 func (r *requestImpl) ParentID() string {
@@ -84,6 +163,9 @@ func (r *requestImpl) Args() []interface{} {
 }
 
 func (r *requestImpl) String() string {
+	if r.Keywords != nil {
+		return fmt.Sprintf("parent(%s) %s(%v)", r.ParentUUID, r.Function, r.Keywords)
+	}
 	return fmt.Sprintf("parent(%s) %s(%v)", r.ParentUUID, r.Function, r.Arguments)
 }
 
@@ -97,11 +179,30 @@ func (r *requestImpl) Request() (Request, error) {
 		return nil, fmt.Errorf("unknown function '%s'", r.Function)
 	}
 
-	req, err := Call(fn, r.Arguments...)
+	var req Request
+	var err error
+	if r.Keywords != nil {
+		req, err = CallKw(fn, r.Keywords)
+	} else {
+		req, err = Call(fn, r.Arguments...)
+	}
+
 	if err != nil {
 		return nil, err
 	}
 
+	if r.Version != "" {
+		req.(*requestImpl).Version = r.Version
+	}
+
+	if r.Key != "" {
+		req.(*requestImpl).Key = r.Key
+	}
+
+	req.(*requestImpl).ExpiresAt = r.ExpiresAt
+	req.(*requestImpl).Priority = r.Priority
+	req.(*requestImpl).RoutingKey = r.RoutingKey
+
 	if r.ParentID() != "" {
 		if req, ok := req.(ParentIDSetter); ok {
 			req.SetParentID(r.ParentUUID)
@@ -120,6 +221,17 @@ func (r *requestImpl) MustRequest() Request {
 	return req
 }
 
+//checkVersion validates that the registered task implements the requested version. Unversioned requests match any
+//version of the task.
+func (r *requestImpl) checkVersion() error {
+	f, ok := registered(r.Fn())
+	if !ok || r.Version == "" || r.Version == f.version {
+		return nil
+	}
+
+	return fmt.Errorf("%w: '%s' version '%s' requested, version '%s' is implemented", ErrVersionMismatch, r.Function, r.Version, f.version)
+}
+
 func (r *requestImpl) Invoke(ctx *Context) (interface{}, error) {
 	log.Debugf("Calling %s", r)
 	fn, ok := Registered(r.Fn())
@@ -128,6 +240,10 @@ func (r *requestImpl) Invoke(ctx *Context) (interface{}, error) {
 		return nil, ErrUnknownFunction
 	}
 
+	if err := r.checkVersion(); err != nil {
+		return nil, err
+	}
+
 	callable := reflect.ValueOf(fn)
 	callableType := callable.Type()
 
@@ -135,17 +251,22 @@ func (r *requestImpl) Invoke(ctx *Context) (interface{}, error) {
 
 	values = append(values, reflect.ValueOf(ctx))
 
+	//a keyword task called without positional arguments gets its struct built from the named arguments
+	if param, ok := kwParam(callableType); ok && len(r.Arguments) == 0 {
+		kwargs, err := buildKwargs(param, r.Keywords)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, kwargs)
+	} else if err := validateArgsCount(callableType, false, len(r.Arguments)); err != nil {
+		return nil, err
+	}
+
 	for i, arg := range r.Args() {
 		argType := expectedAt(callableType, i+1)
-		inValue := reflect.ValueOf(arg)
-
-		switch argType.Kind() {
-		case reflect.Ptr:
-			fallthrough
-		case reflect.Interface:
-			new := reflect.New(inValue.Type())
-			new.Elem().Set(inValue)
-			inValue = new
+		inValue, err := convertValue(arg, argType)
+		if err != nil {
+			return nil, fmt.Errorf("%w at position %d: %s", ErrArgumentMismatch, i+1, err)
 		}
 
 		values = append(values, inValue)
@@ -153,6 +274,14 @@ func (r *requestImpl) Invoke(ctx *Context) (interface{}, error) {
 
 	returns := callable.Call(values)
 
+	//a trailing error return value is never part of the task result
+	if n := len(returns); n > 0 && callableType.Out(n-1) == errorType {
+		if err := returns[n-1].Interface(); err != nil {
+			return nil, err.(error)
+		}
+		returns = returns[:n-1]
+	}
+
 	var result interface{}
 	if len(returns) == 1 {
 		result = returns[0].Interface()
@@ -169,8 +298,7 @@ func expectedAt(fn reflect.Type, i int) reflect.Type {
 	return fn.In(i)
 }
 
-func validateArgs(fn reflect.Type, partial bool, args ...interface{}) error {
-	numIn := len(args)
+func validateArgsCount(fn reflect.Type, partial bool, numIn int) error {
 	expectedIn := fn.NumIn() - 1 //we ignore the context arg
 	if fn.IsVariadic() {
 		expectedIn--
@@ -184,12 +312,20 @@ func validateArgs(fn reflect.Type, partial bool, args ...interface{}) error {
 		return ErrTooManyArguments
 	}
 
+	return nil
+}
+
+func validateArgs(fn reflect.Type, partial bool, args ...interface{}) error {
+	if err := validateArgsCount(fn, partial, len(args)); err != nil {
+		return err
+	}
+
 	for i, arg := range args {
 		actual := reflect.TypeOf(arg)
 		expected := expectedAt(fn, i+1)
 
 		if !actual.AssignableTo(expected) {
-			return fmt.Errorf("argument type mismatch at position %d expected %s got '%s' instead", i+1, expected, actual)
+			return fmt.Errorf("%w at position %d expected %s got '%s' instead", ErrArgumentMismatch, i+1, expected, actual)
 		}
 	}
 
@@ -209,10 +345,19 @@ func makeCall(work interface{}, partial bool, args ...interface{}) (*requestImpl
 	}
 
 	call := &requestImpl{
-		Function:  runtime.FuncForPC(fn.Pointer()).Name(),
+		Function:  nameOf(fn),
+		Version:   versionOf(fn),
 		Arguments: args,
 	}
 
+	if !partial {
+		key, err := keyOf(fn, args)
+		if err != nil {
+			return nil, err
+		}
+		call.Key = key
+	}
+
 	return call, nil
 }
 
@@ -227,7 +372,8 @@ Example:
 	req, _ := wfe.Call(Task, 1, 2)
 	client.Apply(req)
 A call will fail to create a request if the number of arguments doesn't match the required arguments of the task function
-or if the types don't match.
+or if the types don't match. If the task function is registered with RegisterNamed the request carries the explicit task
+name.
 */
 func Call(work interface{}, args ...interface{}) (Request, error) {
 	return makeCall(work, false, args...)
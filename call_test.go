@@ -1,8 +1,10 @@
 package wfe
 
 import (
+	"fmt"
 	"github.com/stretchr/testify/assert"
 	"testing"
+	"time"
 )
 
 func TestCallSuccess(t *testing.T) {
@@ -149,3 +151,116 @@ func TestMustPartialCallPanic(t *testing.T) {
 
 	MustPartialCall(x, "a", 10, 20)
 }
+
+func TestCallVersion(t *testing.T) {
+	RegisterNamed("wfe.test.versioned", wfeVersionTest, Version("2"))
+
+	req := MustCall(wfeVersionTest, 1, 2).(*requestImpl)
+	if ok := assert.Equal(t, "2", req.Version); !ok {
+		t.Fatal()
+	}
+}
+
+type callKwTestArgs struct {
+	Account string        `json:"account" wfe:"required"`
+	Format  string        `json:"format" default:"pdf"`
+	Pages   int           `json:"pages" default:"10"`
+	Wait    time.Duration `json:"wait" default:"5s"`
+	Notes   string
+}
+
+func callKwTest(c *Context, args callKwTestArgs) string {
+	return fmt.Sprintf("%s.%s.%d.%s.%s", args.Account, args.Format, args.Pages, args.Wait, args.Notes)
+}
+
+func callKwPtrTest(c *Context, args *callKwTestArgs) string {
+	return args.Account
+}
+
+func TestCallKwSuccess(t *testing.T) {
+	req, err := CallKw(callKwTest, map[string]interface{}{"account": "acme", "pages": 3})
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, map[string]interface{}{"account": "acme", "pages": 3}, req.(*requestImpl).Keywords); !ok {
+		t.Fatal()
+	}
+}
+
+func TestCallKwErrors(t *testing.T) {
+	x := func(c *Context, a string, b int) {
+
+	}
+
+	for _, c := range []struct {
+		fn     interface{}
+		kwargs map[string]interface{}
+	}{
+		{x, map[string]interface{}{}},
+		{callKwTest, map[string]interface{}{"format": "pdf"}},
+		{callKwTest, map[string]interface{}{"account": "acme", "unknown": 1}},
+		{callKwTest, map[string]interface{}{"account": 10}},
+	} {
+		_, err := CallKw(c.fn, c.kwargs)
+		if ok := assert.Error(t, err); !ok {
+			t.Fatal()
+		}
+	}
+}
+
+func TestRequestKw(t *testing.T) {
+	Register(callKwTest)
+
+	expires := time.Now().Add(time.Hour)
+	kwargs := map[string]interface{}{"account": "acme", "pages": 3}
+	req, err := With(MustCallKw(callKwTest, kwargs), ExpiresAt(expires)).(*requestImpl).Request()
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, kwargs, req.(*requestImpl).Keywords); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, expires, req.(*requestImpl).ExpiresAt); !ok {
+		t.Fatal()
+	}
+}
+
+func TestInvokeKw(t *testing.T) {
+	Register(callKwTest)
+	Register(callKwPtrTest)
+
+	//numbers decoded from JSON are float64
+	req := MustCallKw(callKwTest, map[string]interface{}{"account": "acme", "Notes": "n"})
+	req.(*requestImpl).Keywords["pages"] = float64(3)
+
+	v, err := req.Invoke(NewTestContext("", &DummyClient{}))
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, "acme.pdf.3.5s.n", v); !ok {
+		t.Fatal()
+	}
+
+	v, err = MustCallKw(callKwPtrTest, map[string]interface{}{"account": "acme"}).Invoke(NewTestContext("", &DummyClient{}))
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, "acme", v); !ok {
+		t.Fatal()
+	}
+
+	//positional calls to keyword tasks are still supported
+	v, err = MustCall(callKwTest, callKwTestArgs{Account: "acme"}).Invoke(NewTestContext("", &DummyClient{}))
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, "acme..0.0s.", v); !ok {
+		t.Fatal()
+	}
+}
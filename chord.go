@@ -10,16 +10,12 @@ func chord(c *Context, callback PartialRequest, requests ...Request) interface{}
 		panic(err)
 	}
 
-	for i := 0; i < g.Count(); i++ {
-		r, err := g.ResultOf(i)
-		if err != nil {
-			panic(err)
-		}
-		v, err := r.Get()
-		if err != nil {
-			panic(err)
-		}
+	results, err := g.Results()
+	if err != nil {
+		panic(err)
+	}
 
+	for _, v := range results {
 		callback.Append(v)
 	}
 
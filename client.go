@@ -1,5 +1,10 @@
 package wfe
 
+import (
+	"github.com/pborman/uuid"
+	"time"
+)
+
 //Client interface
 type Client interface {
 	//Apply a task and return a result object
@@ -24,6 +29,12 @@ type Client interface {
 	*/
 	ResultFor(id string) Result
 
+	/*
+		Forget deletes the response of the task id and its offloaded result, it's a NOOP if the result store can't
+		delete responses.
+	*/
+	Forget(id string) error
+
 	/*
 		Close the client.
 	*/
@@ -33,6 +44,8 @@ type Client interface {
 type clientImpl struct {
 	dispatcher Dispatcher
 	store      ResultStore
+	blobs      *offloader
+	keyring    *Keyring
 	parentID   string
 }
 
@@ -48,7 +61,19 @@ func NewClient(o *Options) (Client, error) {
 		return nil, err
 	}
 
-	return newClient(broker, store)
+	blobs, err := newOffloader(o)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := newClient(broker, store)
+	if err != nil {
+		return nil, err
+	}
+
+	client.blobs = blobs
+	client.keyring = o.Keyring
+	return client, nil
 }
 
 func newClient(broker Broker, store ResultStore) (*clientImpl, error) {
@@ -65,13 +90,40 @@ func newClient(broker Broker, store ResultStore) (*clientImpl, error) {
 }
 
 func (c *clientImpl) Close() error {
+	if err := c.blobs.close(); err != nil {
+		log.Errorf("Failed to close blob store: %s", err)
+	}
+
 	return c.dispatcher.Close()
 }
 
+func (c *clientImpl) Forget(id string) error {
+	if c.blobs != nil {
+		response, err := Peek(c.store, id)
+		if err == nil {
+			if err := c.keyring.openResponse(response); err != nil {
+				return err
+			}
+
+			if response.Blob != "" {
+				if err := c.blobs.delete(response.Blob); err != nil {
+					return err
+				}
+			}
+		} else if err != ErrNotFound && err != ErrNotSupported {
+			return err
+		}
+	}
+
+	return Forget(c.store, id)
+}
+
 func (c *clientImpl) ResultFor(id string) Result {
 	return &resultImpl{
-		id:    id,
-		store: c.store,
+		id:      id,
+		store:   c.store,
+		blobs:   c.blobs,
+		keyring: c.keyring,
 	}
 }
 
@@ -87,26 +139,69 @@ func (c *clientImpl) Apply(req Request) (Result, error) {
 		return nil, ErrUnknownFunction
 	}
 
+	req, expires := fn.expire(req)
+	if !expires.IsZero() && !time.Now().Before(expires) {
+		return nil, ErrExpired
+	}
+
+	content, err := c.blobs.request(req)
+	if err != nil {
+		return nil, err
+	}
+
+	//the message id is sealed with the request if the dispatcher lets the client choose it
+	var messageID string
+	ids, dispatchesIDs := c.dispatcher.(IDDispatcher)
+	if c.keyring != nil && dispatchesIDs {
+		messageID = uuid.New()
+	}
+
+	if content, err = c.keyring.sealRequest(content, messageID); err != nil {
+		return nil, err
+	}
+
 	msg := Message{
-		Content: req,
+		Content:   content,
+		Priority:  fn.priorityOf(req),
+		ExpiresAt: expires,
 	}
 
-	o := WorkQueueRoute
-	if fn.queue != "" {
-		o = &RouteOptions{
-			Queue:   fn.queue,
-			Durable: true,
+	o := fn.route()
+	if r, ok := req.(*requestImpl); ok && r.RoutingKey != "" {
+		routed := *o
+		routed.RoutingKey = r.RoutingKey
+		o = &routed
+	}
+
+	dispatch := func() (string, error) {
+		if messageID == "" {
+			return c.dispatcher.Dispatch(o, &msg)
 		}
+
+		if err := ids.DispatchID(o, &msg, messageID); err != nil {
+			return "", err
+		}
+
+		return messageID, nil
+	}
+
+	var id string
+	store, ok := c.store.(IdempotencyStore)
+	if req, isIdempotent := req.(idempotentRequest); isIdempotent && ok && req.IdempotencyKey() != "" {
+		id, err = applyIdempotent(store, req.IdempotencyKey(), fn.idempotencyWindow(), dispatch)
+	} else {
+		id, err = dispatch()
 	}
 
-	id, err := c.dispatcher.Dispatch(o, &msg)
 	if err != nil {
 		return nil, err
 	}
 
 	result := &resultImpl{
-		id:    id,
-		store: c.store,
+		id:      id,
+		store:   c.store,
+		blobs:   c.blobs,
+		keyring: c.keyring,
 	}
 
 	return result, nil
@@ -1,9 +1,12 @@
 package wfe
 
 import (
+	"bytes"
+	"encoding/gob"
 	"errors"
 	"github.com/stretchr/testify/assert"
 	"testing"
+	"time"
 )
 
 func TestNewClient(t *testing.T) {
@@ -156,3 +159,270 @@ func TestClientResultOf(t *testing.T) {
 		t.Fatal("Not resultImpl")
 	}
 }
+
+func TestClientApplyIdempotent(t *testing.T) {
+	broker := &testBroker{}
+	store := &testStore{}
+
+	dispatcher := &testDispatcher{}
+	broker.On("Dispatcher").Return(dispatcher, nil)
+
+	client, err := newClient(broker, store)
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	x := func(c *Context, a, b int) int {
+		return 0
+	}
+
+	RegisterNamed("wfe.test.idempotent", x, Idempotent(time.Minute))
+
+	req := MustCall(x, 1, 2)
+	key := req.(*requestImpl).Key
+	if ok := assert.NotEmpty(t, key); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, key, MustCall(x, 1, 2).(*requestImpl).Key); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.NotEqual(t, key, MustCall(x, 2, 1).(*requestImpl).Key); !ok {
+		t.Fatal()
+	}
+
+	//a partial request gets its key once its arguments are complete
+	partial := MustPartialCall(x, 1)
+	if ok := assert.Empty(t, partial.(*requestImpl).Key); !ok {
+		t.Fatal()
+	}
+
+	partial.Append(2)
+	if ok := assert.Equal(t, key, partial.MustRequest().(*requestImpl).Key); !ok {
+		t.Fatal()
+	}
+
+	store.On("Claim", key, idempotencyPending).Return(true, "", nil).Once()
+	store.On("Bind", key, "1234", time.Minute).Return(nil)
+	dispatcher.On("Dispatch", WorkQueueRoute, &Message{Content: req}).Return("1234", nil).Once()
+
+	result, err := client.Apply(req)
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, "1234", result.ID()); !ok {
+		t.Fatal()
+	}
+
+	//second call returns the same result without dispatching
+	store.On("Claim", key, idempotencyPending).Return(false, "1234", nil).Once()
+	result, err = client.Apply(MustCall(x, 1, 2))
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, "1234", result.ID()); !ok {
+		t.Fatal()
+	}
+
+	if ok := dispatcher.AssertNumberOfCalls(t, "Dispatch", 1); !ok {
+		t.Fatal()
+	}
+}
+
+func TestClientApplyIdempotencyKeyReleased(t *testing.T) {
+	broker := &testBroker{}
+	store := &testStore{}
+
+	dispatcher := &testDispatcher{}
+	broker.On("Dispatcher").Return(dispatcher, nil)
+
+	client, err := newClient(broker, store)
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	x := func(c *Context, a, b int) int {
+		return 0
+	}
+
+	Register(x)
+
+	req := With(MustCall(x, 1, 2), IdempotencyKey("order-1"))
+	store.On("Claim", "order-1", idempotencyPending).Return(true, "", nil)
+	store.On("Release", "order-1").Return(nil)
+	dispatcher.On("Dispatch", WorkQueueRoute, &Message{Content: req}).Return("", errors.New("stupid error"))
+
+	_, err = client.Apply(req)
+	if ok := assert.Error(t, err); !ok {
+		t.Fatal()
+	}
+
+	if ok := store.AssertExpectations(t); !ok {
+		t.Fatal()
+	}
+}
+
+func TestClientApplyIdempotencyBindFailed(t *testing.T) {
+	broker := &testBroker{}
+	store := &testStore{}
+
+	dispatcher := &testDispatcher{}
+	broker.On("Dispatcher").Return(dispatcher, nil)
+
+	client, err := newClient(broker, store)
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	x := func(c *Context, a, b int) int {
+		return 0
+	}
+
+	Register(x)
+
+	req := With(MustCall(x, 1, 2), IdempotencyKey("order-2"))
+	store.On("Claim", "order-2", idempotencyPending).Return(true, "", nil)
+	store.On("Bind", "order-2", "1234", DefaultIdempotencyWindow).Return(errors.New("stupid error"))
+	dispatcher.On("Dispatch", WorkQueueRoute, &Message{Content: req}).Return("1234", nil)
+
+	//the task is dispatched, so its result is returned even if the key can't be bound
+	result, err := client.Apply(req)
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, "1234", result.ID()); !ok {
+		t.Fatal()
+	}
+
+	if ok := store.AssertExpectations(t); !ok {
+		t.Fatal()
+	}
+}
+
+func TestDeriveKey(t *testing.T) {
+	a, b := &convertTestInner{Name: "x"}, &convertTestInner{Name: "x"}
+
+	key, err := deriveKey("wfe.test.key", []interface{}{a, map[string]int{"a": 1, "b": 2}})
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	//pointers are hashed by value
+	other, err := deriveKey("wfe.test.key", []interface{}{b, map[string]int{"b": 2, "a": 1}})
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, key, other); !ok {
+		t.Fatal()
+	}
+
+	b.Name = "y"
+	other, _ = deriveKey("wfe.test.key", []interface{}{b, map[string]int{"b": 2, "a": 1}})
+	if ok := assert.NotEqual(t, key, other); !ok {
+		t.Fatal()
+	}
+
+	_, err = deriveKey("wfe.test.key", []interface{}{make(chan int)})
+	if ok := assert.Error(t, err); !ok {
+		t.Fatal()
+	}
+}
+
+func clientExchangeTest(c *Context, a, b int) int {
+	return a + b
+}
+
+func TestClientApplyExchange(t *testing.T) {
+	broker := &testBroker{}
+	store := &testStore{}
+
+	dispatcher := &testDispatcher{}
+	broker.On("Dispatcher").Return(dispatcher, nil)
+
+	client, err := newClient(broker, store)
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	RegisterNamed("client.exchange", clientExchangeTest, OnExchange("wfe.tenants", "topic", "tenant.default"))
+
+	route := &RouteOptions{
+		Exchange:     "wfe.tenants",
+		ExchangeType: "topic",
+		RoutingKey:   "tenant.default",
+		Durable:      true,
+	}
+
+	req := MustCall(clientExchangeTest, 1, 2)
+	dispatcher.On("Dispatch", route, &Message{Content: req}).Return("1234", nil)
+	if _, err := client.Apply(req); err != nil {
+		t.Fatal(err)
+	}
+
+	routed := *route
+	routed.RoutingKey = "tenant.acme"
+	req = With(MustCall(clientExchangeTest, 3, 4), RoutingKey("tenant.acme"))
+	dispatcher.On("Dispatch", &routed, &Message{Content: req}).Return("5678", nil)
+	if _, err := client.Apply(req); err != nil {
+		t.Fatal(err)
+	}
+
+	if ok := dispatcher.AssertExpectations(t); !ok {
+		t.Fatal()
+	}
+}
+
+func TestChainRoutingKey(t *testing.T) {
+	broker := &testBroker{}
+	store := &testStore{}
+
+	dispatcher := &testDispatcher{}
+	broker.On("Dispatcher").Return(dispatcher, nil)
+
+	client, err := newClient(broker, store)
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	RegisterNamed("client.exchange", clientExchangeTest, OnExchange("wfe.tenants", "topic", "tenant.default"))
+
+	partial := With(MustPartialCall(clientExchangeTest, 1), RoutingKey("tenant.acme"))
+
+	//the chain steps travel through the broker, so the routing key must survive the encoding
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(partial); err != nil {
+		t.Fatal(err)
+	}
+
+	var step requestImpl
+	if err := gob.NewDecoder(&buffer).Decode(&step); err != nil {
+		t.Fatal(err)
+	}
+
+	step.Append(2)
+	req, err := step.Request()
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	route := &RouteOptions{
+		Exchange:     "wfe.tenants",
+		ExchangeType: "topic",
+		RoutingKey:   "tenant.acme",
+		Durable:      true,
+	}
+
+	dispatcher.On("Dispatch", route, &Message{Content: req}).Return("1234", nil)
+	if _, err := client.Apply(req); err != nil {
+		t.Fatal(err)
+	}
+
+	if ok := dispatcher.AssertExpectations(t); !ok {
+		t.Fatal()
+	}
+}
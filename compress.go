@@ -0,0 +1,165 @@
+package wfe
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"io/ioutil"
+	"net/url"
+	"sync"
+)
+
+const (
+	//DefaultCompressMin payloads smaller than this size (in bytes) are not compressed
+	DefaultCompressMin = 512
+
+	//compressed payloads start with a zero byte, which never starts a gob stream, followed by the codec name
+	compressMagic = 0x00
+)
+
+type codec struct {
+	compress   func(data []byte) ([]byte, error)
+	decompress func(data []byte) ([]byte, error)
+}
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+
+	codecs = map[string]codec{
+		"gzip": {
+			compress: func(data []byte) ([]byte, error) {
+				var buffer bytes.Buffer
+				w := gzip.NewWriter(&buffer)
+				if _, err := w.Write(data); err != nil {
+					return nil, err
+				}
+				if err := w.Close(); err != nil {
+					return nil, err
+				}
+				return buffer.Bytes(), nil
+			},
+			decompress: func(data []byte) ([]byte, error) {
+				r, err := gzip.NewReader(bytes.NewReader(data))
+				if err != nil {
+					return nil, err
+				}
+				defer r.Close()
+				return ioutil.ReadAll(r)
+			},
+		},
+		"zstd": {
+			compress: func(data []byte) ([]byte, error) {
+				zstdInit()
+				return zstdEncoder.EncodeAll(data, nil), nil
+			},
+			decompress: func(data []byte) ([]byte, error) {
+				zstdInit()
+				return zstdDecoder.DecodeAll(data, nil)
+			},
+		},
+		"snappy": {
+			compress: func(data []byte) ([]byte, error) {
+				return snappy.Encode(nil, data), nil
+			},
+			decompress: func(data []byte) ([]byte, error) {
+				return snappy.Decode(nil, data)
+			},
+		},
+	}
+)
+
+//zstdInit creates the shared zstd encoder and decoder, both are safe for concurrent EncodeAll and DecodeAll calls
+func zstdInit() {
+	zstdOnce.Do(func() {
+		zstdEncoder, _ = zstd.NewWriter(nil)
+		zstdDecoder, _ = zstd.NewReader(nil)
+	})
+}
+
+//compression compresses the payloads larger than min, a nil compression doesn't compress
+type compression struct {
+	name  string
+	codec codec
+	min   int
+}
+
+//newCompression creates the compression of the codec name (gzip, zstd or snappy), no compression if name is empty.
+//If min is 0 DefaultCompressMin is used
+func newCompression(name string, min int) (*compression, error) {
+	if name == "" {
+		return nil, nil
+	}
+
+	codec, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown compression '%s'", name)
+	}
+
+	if min <= 0 {
+		min = DefaultCompressMin
+	}
+
+	return &compression{
+		name:  name,
+		codec: codec,
+		min:   min,
+	}, nil
+}
+
+//parseCompression reads the `compress` and `compress_min` parameters of a broker url, and removes them from the
+//query so the url can be passed to the broker client.
+func parseCompression(u *url.URL) (*compression, error) {
+	q := u.Query()
+	name := q.Get("compress")
+	min, err := parseInt(q.Get("compress_min"), 0)
+	if err != nil {
+		return nil, err
+	}
+
+	q.Del("compress")
+	q.Del("compress_min")
+	u.RawQuery = q.Encode()
+
+	return newCompression(name, min)
+}
+
+//compress the payload if it's large enough, the codec is flagged in the payload
+func (c *compression) compress(data []byte) ([]byte, error) {
+	if c == nil || len(data) < c.min {
+		return data, nil
+	}
+
+	compressed, err := c.codec.compress(data)
+	if err != nil {
+		return nil, err
+	}
+
+	framed := make([]byte, 0, 2+len(c.name)+len(compressed))
+	framed = append(framed, compressMagic, byte(len(c.name)))
+	framed = append(framed, c.name...)
+	return append(framed, compressed...), nil
+}
+
+//decompress a payload compressed by any codec, uncompressed payloads are returned as is. The consumers don't need
+//to be configured with the compression of the producers.
+func decompress(data []byte) ([]byte, error) {
+	if len(data) == 0 || data[0] != compressMagic {
+		return data, nil
+	}
+
+	if len(data) < 2 || len(data) < 2+int(data[1]) {
+		return nil, fmt.Errorf("invalid compressed payload")
+	}
+
+	name := string(data[2 : 2+int(data[1])])
+	codec, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown compression '%s'", name)
+	}
+
+	return codec.decompress(data[2+int(data[1]):])
+}
@@ -0,0 +1,118 @@
+package wfe
+
+import (
+	"bytes"
+	"encoding/gob"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCompression(t *testing.T) {
+	data := []byte(strings.Repeat("compress me ", 1000))
+	for name := range codecs {
+		c, err := newCompression(name, 0)
+		if ok := assert.Nil(t, err); !ok {
+			t.Fatal()
+		}
+
+		compressed, err := c.compress(data)
+		if ok := assert.Nil(t, err); !ok {
+			t.Fatal()
+		}
+
+		if ok := assert.True(t, len(compressed) < len(data), name); !ok {
+			t.Fatal()
+		}
+
+		decompressed, err := decompress(compressed)
+		if ok := assert.Nil(t, err); !ok {
+			t.Fatal()
+		}
+
+		if ok := assert.Equal(t, data, decompressed, name); !ok {
+			t.Fatal()
+		}
+	}
+}
+
+func TestCompressionSmallPayload(t *testing.T) {
+	c, err := newCompression("gzip", 0)
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	compressed, err := c.compress([]byte("small"))
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, []byte("small"), compressed); !ok {
+		t.Fatal()
+	}
+
+	data, err := decompress(compressed)
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, []byte("small"), data); !ok {
+		t.Fatal()
+	}
+}
+
+func TestParseCompression(t *testing.T) {
+	u, _ := url.Parse("amqp://localhost:5672/?compress=zstd&compress_min=10&heartbeat=5")
+	c, err := parseCompression(u)
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, "zstd", c.name); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, 10, c.min); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, "heartbeat=5", u.RawQuery); !ok {
+		t.Fatal()
+	}
+
+	u, _ = url.Parse("amqp://localhost:5672/?compress=lz4")
+	_, err = parseCompression(u)
+	if ok := assert.Error(t, err); !ok {
+		t.Fatal()
+	}
+}
+
+func TestAMQPDeliveryCompressed(t *testing.T) {
+	req := MustCall(wfeAddTest, 1, 2)
+
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(req); err != nil {
+		t.Fatal(err)
+	}
+
+	c, _ := newCompression("snappy", 1)
+	body, err := c.compress(buffer.Bytes())
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	delivery := &amqpDelivery{
+		Delivery: amqp.Delivery{Body: body},
+	}
+
+	var decoded requestImpl
+	if ok := assert.Nil(t, delivery.Content(&decoded)); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, req.Args(), decoded.Args()); !ok {
+		t.Fatal()
+	}
+}
@@ -0,0 +1,226 @@
+package wfe
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+)
+
+var (
+	//ErrArgumentMismatch a request argument can't be converted to the type expected by the task.
+	ErrArgumentMismatch = errors.New("argument type mismatch")
+)
+
+//convertValue converts a decoded argument to the type expected by the task. Brokers decode the arguments without
+//knowing the task signature, so a value can be of a different (but compatible) type than the task parameter. For
+//example an `int64` for an `int`, a struct for a pointer to struct, a `[]interface{}` for a `[]string` or a
+//`map[string]interface{}` (as decoded from JSON) for a struct.
+func convertValue(raw interface{}, t reflect.Type) (reflect.Value, error) {
+	if raw == nil {
+		return reflect.Zero(t), nil
+	}
+
+	return convert(reflect.ValueOf(raw), t)
+}
+
+func convert(v reflect.Value, t reflect.Type) (reflect.Value, error) {
+	for v.IsValid() && v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+
+	if !v.IsValid() {
+		return reflect.Zero(t), nil
+	}
+
+	if v.Type() == t {
+		return v, nil
+	}
+
+	switch t.Kind() {
+	case reflect.Interface:
+		if v.Type().Implements(t) {
+			return v, nil
+		}
+		//methods with pointer receivers
+		if v.Kind() != reflect.Ptr && reflect.PtrTo(v.Type()).Implements(t) {
+			p := reflect.New(v.Type())
+			p.Elem().Set(v)
+			return p, nil
+		}
+		return v, mismatch(v, t)
+	case reflect.Ptr:
+		if v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Zero(t), nil
+			}
+			v = v.Elem()
+		}
+		e, err := convert(v, t.Elem())
+		if err != nil {
+			return v, err
+		}
+		p := reflect.New(t.Elem())
+		p.Elem().Set(e)
+		return p, nil
+	}
+
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return reflect.Zero(t), nil
+		}
+		return convert(v.Elem(), t)
+	}
+
+	switch {
+	case isNumeric(t.Kind()) && isNumeric(v.Kind()):
+		return convertNumber(v, t)
+	case t.Kind() == reflect.String && v.Kind() == reflect.String,
+		t.Kind() == reflect.Bool && v.Kind() == reflect.Bool:
+		return v.Convert(t), nil
+	case t.Kind() == reflect.Slice && (v.Kind() == reflect.Slice || v.Kind() == reflect.Array):
+		s := reflect.MakeSlice(t, v.Len(), v.Len())
+		return s, convertElems(v, s)
+	case t.Kind() == reflect.Array && (v.Kind() == reflect.Slice || v.Kind() == reflect.Array):
+		if v.Len() != t.Len() {
+			return v, fmt.Errorf("expected %s got %d elements instead", t, v.Len())
+		}
+		a := reflect.New(t).Elem()
+		return a, convertElems(v, a)
+	case t.Kind() == reflect.Map && v.Kind() == reflect.Map:
+		return convertMap(v, t)
+	case t.Kind() == reflect.Struct && v.Kind() == reflect.Struct:
+		return convertStruct(v, t)
+	case t.Kind() == reflect.Struct && v.Kind() == reflect.Map && v.Type().Key().Kind() == reflect.String:
+		return convertMapToStruct(v, t)
+	}
+
+	if v.Type().AssignableTo(t) {
+		return v, nil
+	}
+
+	return v, mismatch(v, t)
+}
+
+func mismatch(v reflect.Value, t reflect.Type) error {
+	return fmt.Errorf("expected %s got '%s' instead", t, v.Type())
+}
+
+func isNumeric(k reflect.Kind) bool {
+	return k >= reflect.Int && k <= reflect.Float64
+}
+
+func isInteger(k reflect.Kind) bool {
+	return k >= reflect.Int && k <= reflect.Uintptr
+}
+
+//convertNumber converts between numeric types, it fails if the value doesn't fit in the target integer type
+func convertNumber(v reflect.Value, t reflect.Type) (reflect.Value, error) {
+	if isInteger(t.Kind()) && !fitsInteger(v, t) {
+		return v, fmt.Errorf("value %v overflows %s", v.Interface(), t)
+	}
+
+	return v.Convert(t), nil
+}
+
+//fitsInteger reports if the numeric value is a whole number in the range of the integer type t
+func fitsInteger(v reflect.Value, t reflect.Type) bool {
+	target := reflect.Zero(t)
+	signed := t.Kind() >= reflect.Int && t.Kind() <= reflect.Int64
+
+	switch {
+	case v.Kind() >= reflect.Int && v.Kind() <= reflect.Int64:
+		n := v.Int()
+		if signed {
+			return !target.OverflowInt(n)
+		}
+		return n >= 0 && !target.OverflowUint(uint64(n))
+	case v.Kind() >= reflect.Uint && v.Kind() <= reflect.Uintptr:
+		n := v.Uint()
+		if signed {
+			return n <= math.MaxInt64 && !target.OverflowInt(int64(n))
+		}
+		return !target.OverflowUint(n)
+	default:
+		f := v.Float()
+		if f != math.Trunc(f) {
+			return false
+		}
+		if signed {
+			//float64(math.MaxInt64) rounds up to 2^63
+			return f >= math.MinInt64 && f < math.MaxInt64 && !target.OverflowInt(int64(f))
+		}
+		return f >= 0 && f < math.MaxUint64 && !target.OverflowUint(uint64(f))
+	}
+}
+
+func convertElems(from, to reflect.Value) error {
+	for i := 0; i < from.Len(); i++ {
+		e, err := convert(from.Index(i), to.Type().Elem())
+		if err != nil {
+			return fmt.Errorf("[%d]: %s", i, err)
+		}
+		to.Index(i).Set(e)
+	}
+
+	return nil
+}
+
+func convertMap(v reflect.Value, t reflect.Type) (reflect.Value, error) {
+	m := reflect.MakeMapWithSize(t, v.Len())
+	for _, key := range v.MapKeys() {
+		k, err := convert(key, t.Key())
+		if err != nil {
+			return v, fmt.Errorf("key %v: %s", key.Interface(), err)
+		}
+		e, err := convert(v.MapIndex(key), t.Elem())
+		if err != nil {
+			return v, fmt.Errorf("[%v]: %s", key.Interface(), err)
+		}
+		m.SetMapIndex(k, e)
+	}
+
+	return m, nil
+}
+
+func convertStruct(v reflect.Value, t reflect.Type) (reflect.Value, error) {
+	s := reflect.New(t).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+
+		from := v.FieldByName(f.Name)
+		if !from.IsValid() {
+			continue
+		}
+
+		e, err := convert(from, f.Type)
+		if err != nil {
+			return v, fmt.Errorf("%s: %s", f.Name, err)
+		}
+		s.Field(i).Set(e)
+	}
+
+	return s, nil
+}
+
+//convertMapToStruct maps the keys of a map on the struct fields, named the same way as keyword arguments
+func convertMapToStruct(v reflect.Value, t reflect.Type) (reflect.Value, error) {
+	s := reflect.New(t).Elem()
+	for _, f := range kwFields(t) {
+		from := v.MapIndex(reflect.ValueOf(f.name).Convert(v.Type().Key()))
+		if !from.IsValid() {
+			continue
+		}
+
+		e, err := convert(from, s.Field(f.index).Type())
+		if err != nil {
+			return v, fmt.Errorf("%s: %s", f.name, err)
+		}
+		s.Field(f.index).Set(e)
+	}
+
+	return s, nil
+}
@@ -0,0 +1,120 @@
+package wfe
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"reflect"
+	"testing"
+)
+
+type convertTestInner struct {
+	Name string `json:"name"`
+	Tags []string
+}
+
+type convertTestOuter struct {
+	ID    int `json:"id"`
+	Inner *convertTestInner
+	Attrs map[string]float64
+}
+
+func TestConvertValueOk(t *testing.T) {
+	for _, c := range []struct {
+		in       interface{}
+		expected interface{}
+	}{
+		{int64(10), 10},
+		{float64(3), uint8(3)},
+		{uint64(math.MaxInt64), int64(math.MaxInt64)},
+		{float64(-1 << 63), int64(-1 << 63)},
+		{int32(3), float64(3)},
+		{[]interface{}{"a", "b"}, []string{"a", "b"}},
+		{[]interface{}{int64(1), 2}, [2]int{1, 2}},
+		{map[string]interface{}{"a": 1}, map[string]float64{"a": 1}},
+		{wfeTestStruct{"x"}, &wfeTestStruct{"x"}},
+		{&wfeTestStruct{"x"}, wfeTestStruct{"x"}},
+		{
+			map[string]interface{}{
+				"id": float64(1),
+				"Inner": map[string]interface{}{
+					"name": "inner",
+					"Tags": []interface{}{"t"},
+				},
+				"Attrs": map[string]interface{}{"x": int64(2)},
+			},
+			convertTestOuter{
+				ID:    1,
+				Inner: &convertTestInner{Name: "inner", Tags: []string{"t"}},
+				Attrs: map[string]float64{"x": 2},
+			},
+		},
+	} {
+		v, err := convertValue(c.in, reflect.TypeOf(c.expected))
+		if ok := assert.Nil(t, err); !ok {
+			t.Fatal()
+		}
+
+		if ok := assert.Equal(t, c.expected, v.Interface()); !ok {
+			t.Fatal()
+		}
+	}
+}
+
+func TestConvertValueError(t *testing.T) {
+	for _, c := range []struct {
+		in       interface{}
+		expected reflect.Type
+	}{
+		{"10", reflect.TypeOf(0)},
+		{3.5, reflect.TypeOf(0)},
+		{300, reflect.TypeOf(uint8(0))},
+		{-1, reflect.TypeOf(uint(0))},
+		{uint64(math.MaxInt64 + 1), reflect.TypeOf(int64(0))},
+		{uint64(math.MaxUint64), reflect.TypeOf(0)},
+		{float64(1 << 63), reflect.TypeOf(int64(0))},
+		{math.NaN(), reflect.TypeOf(0)},
+		{[]interface{}{"a", 1}, reflect.TypeOf([]string{})},
+		{map[string]interface{}{"id": "x"}, reflect.TypeOf(convertTestOuter{})},
+		{10, reflect.TypeOf((*Request)(nil)).Elem()},
+	} {
+		_, err := convertValue(c.in, c.expected)
+		if ok := assert.Error(t, err); !ok {
+			t.Fatal()
+		}
+	}
+}
+
+func convertAddTest(c *Context, a, b int) int {
+	return a + b
+}
+
+func TestInvokeArgumentMismatch(t *testing.T) {
+	Register(convertAddTest)
+
+	req := requestImpl{
+		Function:  "github.com/conictus/wfe.convertAddTest",
+		Arguments: []interface{}{int64(1), "2"},
+	}
+
+	_, err := req.Invoke(NewTestContext("", &DummyClient{}))
+	if ok := assert.True(t, errors.Is(err, ErrArgumentMismatch)); !ok {
+		t.Fatal()
+	}
+
+	req.Arguments = []interface{}{int64(1)}
+	_, err = req.Invoke(NewTestContext("", &DummyClient{}))
+	if ok := assert.Equal(t, ErrTooFewArguments, err); !ok {
+		t.Fatal()
+	}
+
+	req.Arguments = []interface{}{int64(1), int32(2)}
+	v, err := req.Invoke(NewTestContext("", &DummyClient{}))
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, 3, v); !ok {
+		t.Fatal()
+	}
+}
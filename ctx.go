@@ -5,8 +5,10 @@ import "fmt"
 //Context is always the first argument to a Task function. It's mainly used by a task to start and spawn other tasks.
 //Context implements the Client interface.
 type Context struct {
-	client Client
-	id     string
+	client  Client
+	store   ResultStore
+	keyring *Keyring
+	id      string
 
 	values map[string]interface{}
 }
@@ -77,6 +79,11 @@ func (c *Context) ResultFor(id string) Result {
 	return c.client.ResultFor(id)
 }
 
+//Forget deletes the response of the task id and its offloaded result
+func (c *Context) Forget(id string) error {
+	return c.client.Forget(id)
+}
+
 func (c *Context) Close() error {
 	//do nothing
 	return nil
@@ -7,48 +7,123 @@ import (
 	"github.com/conictus/disque"
 	"github.com/garyburd/redigo/redis"
 	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
+const (
+	disqueReconnectMin = 500 * time.Millisecond
+	disqueReconnectMax = 30 * time.Second
+
+	//disquePrioritySep separates a queue from its priority in the name of a priority sub queue, the queue names can't
+	//contain it
+	disquePrioritySep = "#p"
+)
+
+//DisqueOptions configures the disque broker
+type DisqueOptions struct {
+	//Addrs of the disque nodes, the next node is used if a node is not reachable
+	Addrs    []string
+	Password string
+
+	//Job default delivery options of the jobs
+	Job JobOptions
+	//Queues delivery options by queue name, they override the Job defaults. The options of a task (see Job) override
+	//the options of its queue
+	Queues map[string]JobOptions
+
+	//Compress the jobs with gzip, zstd or snappy if they are larger than CompressMin bytes (DefaultCompressMin if 0).
+	//Encrypted jobs don't compress, see Keyring.Compress
+	Compress    string
+	CompressMin int
+
+	MaxIdle     int
+	IdleTimeout time.Duration
+
+	DialOptions []redis.DialOption
+}
+
 func init() {
 	RegisterBroker("disque", func(u *url.URL) (Broker, error) {
-		pool, err := disque.New(u.Host)
-		if err != nil {
-			return nil, err
+		q := u.Query()
+		o := DisqueOptions{
+			Addrs:    strings.Split(u.Host, ","),
+			Compress: q.Get("compress"),
 		}
 
-		if err := pool.Ping(); err != nil {
-			return nil, err
+		if u.User != nil {
+			if pass, ok := u.User.Password(); ok {
+				o.Password = pass
+			} else {
+				o.Password = u.User.Username()
+			}
 		}
 
-		retry, err := parseInt(u.Query().Get("retry"), 0)
-		if err != nil {
-			return nil, err
+		var retry, delay, ttl, idle int
+		for _, p := range []struct {
+			v   *int
+			s   string
+			def int
+		}{
+			{&retry, q.Get("retry"), 0},
+			{&delay, q.Get("delay"), 0},
+			{&ttl, q.Get("ttl"), 0},
+			{&o.Job.MaxLen, q.Get("maxlen"), 0},
+			{&o.Job.Replicate, q.Get("replicate"), 0},
+			{&o.MaxIdle, q.Get("max_idle"), 3},
+			{&idle, q.Get("idle_timeout"), 240},
+			{&o.CompressMin, q.Get("compress_min"), 0},
+		} {
+			v, err := parseInt(p.s, p.def)
+			if err != nil {
+				return nil, err
+			}
+			*p.v = v
 		}
 
-		return &disqueBroker{pool: pool.RetryAfter(time.Duration(retry) * time.Second)}, nil
+		o.Job.Retry = time.Duration(retry) * time.Second
+		o.Job.Delay = time.Duration(delay) * time.Second
+		o.Job.TTL = time.Duration(ttl) * time.Second
+		o.IdleTimeout = time.Duration(idle) * time.Second
+
+		return NewDisqueBrokerWithOptions(o)
 	})
 }
 
+//NewDisqueBroker creates a disque broker for a single node
 func NewDisqueBroker(server string, password string, options ...redis.DialOption) (Broker, error) {
-	pool := &redis.Pool{
+	return NewDisqueBrokerWithOptions(DisqueOptions{
+		Addrs:       []string{server},
+		Password:    password,
 		MaxIdle:     3,
 		IdleTimeout: 240 * time.Second,
-		Dial: func() (redis.Conn, error) {
-			c, err := redis.Dial("tcp", server, options...)
-			if err != nil {
-				return nil, err
-			}
+		DialOptions: options,
+	})
+}
 
-			if password != "" {
-				if _, err := c.Do("AUTH", password); err != nil {
-					c.Close()
-					return nil, err
-				}
-			}
+/*
+NewDisqueBrokerWithOptions creates a disque broker. The broker can also be created from the Options.Broker url, the
+durations are in seconds
 
-			return c, err
-		},
+	disque://:pass@node1:7711,node2:7711?retry=60&ttl=86400&replicate=2&maxlen=100000
+*/
+func NewDisqueBrokerWithOptions(o DisqueOptions) (Broker, error) {
+	if len(o.Addrs) == 0 || o.Addrs[0] == "" {
+		return nil, fmt.Errorf("missing disque address")
+	}
+
+	compression, err := newCompression(o.Compress, o.CompressMin)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := &redis.Pool{
+		MaxIdle:     o.MaxIdle,
+		IdleTimeout: o.IdleTimeout,
+		Dial:        o.dial,
 		TestOnBorrow: func(c redis.Conn, t time.Time) error {
 			_, err := c.Do("PING")
 			return err
@@ -63,13 +138,52 @@ func NewDisqueBroker(server string, password string, options ...redis.DialOption
 	}
 
 	return &disqueBroker{
-		pool: disque.NewWithPool(pool),
+		pool:        disque.NewWithPool(pool),
+		conn:        pool,
+		opts:        o,
+		compression: compression,
 	}, nil
 }
 
+//dial the first reachable node
+func (o *DisqueOptions) dial() (redis.Conn, error) {
+	var err error
+	for _, addr := range o.Addrs {
+		var c redis.Conn
+		if c, err = redis.Dial("tcp", addr, o.DialOptions...); err != nil {
+			continue
+		}
+
+		if o.Password != "" {
+			if _, err = c.Do("AUTH", o.Password); err != nil {
+				c.Close()
+				continue
+			}
+		}
+
+		return c, nil
+	}
+
+	return nil, err
+}
+
 type disqueBroker struct {
 	pool *disque.Pool
-	opt  *RouteOptions
+	//conn runs the commands the disque client doesn't implement
+	conn        *redis.Pool
+	opts        DisqueOptions
+	compression *compression
+
+	m      sync.Mutex
+	closed bool
+}
+
+type disqueConsumer struct {
+	broker *disqueBroker
+	opt    *RouteOptions
+
+	m      sync.Mutex
+	closed bool
 }
 
 type disqueDelivery struct {
@@ -85,31 +199,107 @@ func (d *disqueDelivery) Confirm() error {
 	return d.pool.Ack(d.j)
 }
 
-func (d *disqueDelivery) Content(c interface{}) error {
-	//un serialize the body and return a valid call
-	decoder := gob.NewDecoder(bytes.NewBufferString(d.j.Data))
-	if err := decoder.Decode(c); err != nil {
-		return err
-	}
+func (d *disqueDelivery) Requeue() error {
+	return d.pool.Nack(d.j)
+}
 
-	return nil
+func (d *disqueDelivery) Redeliveries() int {
+	return d.j.Nacks
+}
+
+func (d *disqueDelivery) Content(c interface{}) error {
+	return decodeContent([]byte(d.j.Data), c)
 }
 
 func (b *disqueBroker) Close() error {
+	b.m.Lock()
+	b.closed = true
+	b.m.Unlock()
+
 	return b.pool.Close()
 }
 
+func (b *disqueBroker) isClosed() bool {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	return b.closed
+}
+
 func (b *disqueBroker) Dispatcher() (Dispatcher, error) {
 	return b, nil
 }
 
 func (b *disqueBroker) Consumer(o *RouteOptions) (Consumer, error) {
-	return &disqueBroker{
-		pool: b.pool,
-		opt:  o,
+	for _, queue := range append([]string{o.Queue}, o.Queues...) {
+		if err := checkDisqueQueue(queue); err != nil {
+			return nil, err
+		}
+	}
+
+	return &disqueConsumer{
+		broker: b,
+		opt:    o,
 	}, nil
 }
 
+//job returns the delivery options of a job: the task options override the queue options, which override the defaults.
+//A job expiring before its TTL is dropped when it expires.
+func (b *disqueBroker) job(queue string, o *RouteOptions, msg *Message) (JobOptions, error) {
+	job := b.opts.Job
+	if q, ok := b.opts.Queues[queue]; ok {
+		job = job.merge(&q)
+	}
+	job = job.merge(o.Job)
+
+	if !msg.ExpiresAt.IsZero() {
+		//disque TTLs are in seconds
+		ttl := time.Until(msg.ExpiresAt).Round(time.Second)
+		if ttl < time.Second {
+			return job, ErrExpired
+		}
+
+		if job.TTL == 0 || ttl < job.TTL {
+			job.TTL = ttl
+		}
+	}
+
+	//disque refuses jobs that are retried after they expire
+	if job.TTL > 0 && job.Retry >= job.TTL {
+		job.Retry = job.TTL - time.Second
+	}
+
+	return job, nil
+}
+
+//jobPool returns a pool that adds the jobs with the given options. The pool options apply to all the jobs added with
+//the pool, so a copy is configured
+func (b *disqueBroker) jobPool(job JobOptions) *disque.Pool {
+	if job == (JobOptions{}) {
+		return b.pool
+	}
+
+	copied := *b.pool
+	pool := &copied
+	if job.Retry > 0 {
+		pool = pool.RetryAfter(job.Retry)
+	}
+	if job.Delay > 0 {
+		pool = pool.Delay(job.Delay)
+	}
+	if job.TTL > 0 {
+		pool = pool.TTL(job.TTL)
+	}
+	if job.MaxLen > 0 {
+		pool = pool.MaxLen(job.MaxLen)
+	}
+	if job.Replicate > 0 {
+		pool = pool.ReplicateAtLeast(job.Replicate)
+	}
+
+	return pool
+}
+
 func (b *disqueBroker) Dispatch(o *RouteOptions, msg *Message) (string, error) {
 	var buffer bytes.Buffer
 	encoder := gob.NewEncoder(&buffer)
@@ -117,35 +307,118 @@ func (b *disqueBroker) Dispatch(o *RouteOptions, msg *Message) (string, error) {
 		return "", err
 	}
 
+	data, err := b.compression.compress(buffer.Bytes())
+	if err != nil {
+		return "", err
+	}
+
+	if o.Exchange != "" {
+		return "", fmt.Errorf("exchanges are not supported by the disque broker")
+	}
+
 	queue := o.Queue
 
 	if queue == "" {
 		return "", fmt.Errorf("queue is not set")
 	}
 
-	job, err := b.pool.Add(buffer.String(), queue)
+	if err := checkDisqueQueue(queue); err != nil {
+		return "", err
+	}
+
+	job, err := b.job(queue, o, msg)
+	if err != nil {
+		return "", err
+	}
+
+	added, err := b.jobPool(job).Add(string(data), disqueQueue(queue, clampPriority(msg.Priority)))
 	if err != nil {
 		return "", err
 	}
 
-	return job.ID, nil
+	return added.ID, nil
+}
+
+//disqueQueue returns the sub queue of a priority, the lowest priority jobs are queued on the queue itself
+func disqueQueue(queue string, priority int) string {
+	if priority == 0 {
+		return queue
+	}
+
+	return fmt.Sprintf("%s%s%d", queue, disquePrioritySep, priority)
 }
 
-func (b *disqueBroker) Consume() (<-chan Delivery, error) {
+//checkDisqueQueue rejects the queue names that could be taken for a priority sub queue
+func checkDisqueQueue(queue string) error {
+	if strings.Contains(queue, disquePrioritySep) {
+		return fmt.Errorf("disque queue '%s' can't contain '%s'", queue, disquePrioritySep)
+	}
+
+	return nil
+}
+
+//disqueQueues returns the sub queues of all the priorities of the queues, highest priority first
+func disqueQueues(queues ...string) []string {
+	subs := make([]string, 0, len(queues)*(MaxPriority+1))
+	for priority := MaxPriority; priority >= 0; priority-- {
+		for _, queue := range queues {
+			subs = append(subs, disqueQueue(queue, priority))
+		}
+	}
+
+	return subs
+}
+
+func (c *disqueConsumer) isClosed() bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	return c.closed || c.broker.isClosed()
+}
+
+/*
+Consume the jobs of the queue and the extra RouteOptions.Queues with a single GETJOB. Disque returns the jobs of the
+first non empty queue, so the queues (and their priority sub queues) are polled in order. GETJOB errors, for example
+while a node restarts, are retried with a backoff, the deliveries channel is only closed once the consumer (or the
+broker) is closed.
+*/
+func (c *disqueConsumer) Consume() (<-chan Delivery, error) {
+	pool := c.broker.pool
+	queues := disqueQueues(append([]string{c.opt.Queue}, c.opt.Queues...)...)
 	deliveries := make(chan Delivery)
 	go func() {
 		defer close(deliveries)
+		backoff := disqueReconnectMin
 		for {
-			job, err := b.pool.Get(b.opt.Queue)
-			if err != nil {
+			job, err := pool.Get(queues...)
+			if c.isClosed() {
+				if err == nil && job != nil && !c.opt.AutoConfirm {
+					//give the job back for a fast redelivery to another consumer
+					pool.Nack(job)
+				}
 				return
 			}
-			if b.opt.AutoConfirm {
-				b.pool.Ack(job)
+
+			if err != nil {
+				log.Errorf("Failed to get jobs of queue '%s': %s", c.opt.Queue, err)
+				time.Sleep(backoff)
+				if backoff *= 2; backoff > disqueReconnectMax {
+					backoff = disqueReconnectMax
+				}
+				continue
+			}
+
+			backoff = disqueReconnectMin
+			if job == nil {
+				continue
+			}
+
+			if c.opt.AutoConfirm {
+				pool.Ack(job)
 			}
 
 			deliveries <- &disqueDelivery{
-				pool: b.pool,
+				pool: pool,
 				j:    job,
 			}
 		}
@@ -153,3 +426,171 @@ func (b *disqueBroker) Consume() (<-chan Delivery, error) {
 
 	return deliveries, nil
 }
+
+func (c *disqueConsumer) Close() error {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.closed = true
+	return nil
+}
+
+//disqueAdminBatch number of jobs peeked at once while purging a queue
+const disqueAdminBatch = 1000
+
+//disqueBase returns the queue of a priority sub queue
+func disqueBase(queue string) string {
+	if i := strings.LastIndex(queue, disquePrioritySep); i > 0 {
+		if priority, err := strconv.Atoi(queue[i+len(disquePrioritySep):]); err == nil && priority > 0 && priority <= MaxPriority {
+			return queue[:i]
+		}
+	}
+
+	return queue
+}
+
+//QueueLength sums the lengths of the queue priority sub queues
+func (b *disqueBroker) QueueLength(queue string) (int, error) {
+	c := b.conn.Get()
+	defer c.Close()
+
+	length := 0
+	for _, sub := range disqueQueues(queue) {
+		n, err := redis.Int(c.Do("QLEN", sub))
+		if err != nil {
+			return 0, err
+		}
+		length += n
+	}
+
+	return length, nil
+}
+
+//peek returns the ids and bodies of the next n jobs of a sub queue
+func (b *disqueBroker) peek(c redis.Conn, queue string, n int) ([]string, []string, error) {
+	jobs, err := redis.Values(c.Do("QPEEK", queue, n))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ids := make([]string, 0, len(jobs))
+	bodies := make([]string, 0, len(jobs))
+	for _, job := range jobs {
+		fields, err := redis.Strings(job, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if len(fields) < 3 {
+			return nil, nil, fmt.Errorf("unexpected QPEEK reply")
+		}
+
+		ids = append(ids, fields[1])
+		bodies = append(bodies, fields[2])
+	}
+
+	return ids, bodies, nil
+}
+
+//Purge deletes the jobs of the queue priority sub queues, disque has no command to empty a queue at once
+func (b *disqueBroker) Purge(queue string) (int, error) {
+	c := b.conn.Get()
+	defer c.Close()
+
+	purged := 0
+	for _, sub := range disqueQueues(queue) {
+		for {
+			ids, _, err := b.peek(c, sub, disqueAdminBatch)
+			if err != nil {
+				return purged, err
+			}
+
+			if len(ids) == 0 {
+				break
+			}
+
+			n, err := redis.Int(c.Do("DELJOB", redis.Args{}.AddFlat(ids)...))
+			if err != nil {
+				return purged, err
+			}
+
+			purged += n
+			if n == 0 {
+				//the jobs are not known by this node
+				break
+			}
+		}
+	}
+
+	return purged, nil
+}
+
+//ListQueues lists the queues of the node, the priority sub queues are listed as their queue
+func (b *disqueBroker) ListQueues() ([]string, error) {
+	c := b.conn.Get()
+	defer c.Close()
+
+	seen := make(map[string]struct{})
+	var queues []string
+	cursor := "0"
+	for {
+		reply, err := redis.Values(c.Do("QSCAN", cursor))
+		if err != nil {
+			return nil, err
+		}
+
+		var names []string
+		if _, err := redis.Scan(reply, &cursor, &names); err != nil {
+			return nil, err
+		}
+
+		for _, name := range names {
+			name = disqueBase(name)
+			if _, ok := seen[name]; !ok {
+				seen[name] = struct{}{}
+				queues = append(queues, name)
+			}
+		}
+
+		if cursor == "0" {
+			break
+		}
+	}
+
+	sort.Strings(queues)
+	return queues, nil
+}
+
+//DeleteQueue purges the queue, disque deletes the empty queues
+func (b *disqueBroker) DeleteQueue(queue string) error {
+	_, err := b.Purge(queue)
+	return err
+}
+
+//Peek returns the next n jobs of the queue, highest priority first
+func (b *disqueBroker) Peek(queue string, n int) ([]Request, error) {
+	c := b.conn.Get()
+	defer c.Close()
+
+	var requests []Request
+	for _, sub := range disqueQueues(queue) {
+		if len(requests) >= n {
+			break
+		}
+
+		_, bodies, err := b.peek(c, sub, n-len(requests))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, body := range bodies {
+			var req requestImpl
+			if err := decodeContent([]byte(body), &req); err != nil {
+				return nil, err
+			}
+			requests = append(requests, &req)
+		}
+	}
+
+	return requests, nil
+}
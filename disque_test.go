@@ -0,0 +1,85 @@
+package wfe
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestDisqueJobOptions(t *testing.T) {
+	broker := &disqueBroker{
+		opts: DisqueOptions{
+			Job: JobOptions{Retry: time.Minute, Replicate: 2},
+			Queues: map[string]JobOptions{
+				"mail": {Retry: 5 * time.Minute, TTL: time.Hour},
+			},
+		},
+	}
+
+	job, err := broker.job("other", &RouteOptions{Queue: "other"}, &Message{})
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, JobOptions{Retry: time.Minute, Replicate: 2}, job); !ok {
+		t.Fatal()
+	}
+
+	route := &RouteOptions{Queue: "mail", Job: &JobOptions{Delay: time.Second, Replicate: 3}}
+	job, _ = broker.job("mail", route, &Message{})
+	if ok := assert.Equal(t, JobOptions{Retry: 5 * time.Minute, Delay: time.Second, TTL: time.Hour, Replicate: 3}, job); !ok {
+		t.Fatal()
+	}
+
+	//an expiring message shortens the TTL, the retry must be shorter than the TTL
+	job, _ = broker.job("mail", route, &Message{ExpiresAt: time.Now().Add(2 * time.Minute)})
+	if ok := assert.Equal(t, 2*time.Minute, job.TTL); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, time.Minute+59*time.Second, job.Retry); !ok {
+		t.Fatal()
+	}
+
+	_, err = broker.job("mail", route, &Message{ExpiresAt: time.Now()})
+	if ok := assert.Equal(t, ErrExpired, err); !ok {
+		t.Fatal()
+	}
+}
+
+func TestDisqueQueuesOrder(t *testing.T) {
+	queues := disqueQueues("mail", "reports")
+	if ok := assert.Equal(t, []string{"mail#p9", "reports#p9", "mail#p8"}, queues[:3]); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, []string{"mail", "reports"}, queues[len(queues)-2:]); !ok {
+		t.Fatal()
+	}
+}
+
+func TestDisqueBase(t *testing.T) {
+	for queue, base := range map[string]string{
+		"mail":       "mail",
+		"mail#p3":    "mail",
+		"mail#p0":    "mail#p0",
+		"mail#p10":   "mail#p10",
+		"mail#pages": "mail#pages",
+		"a#p1#p9":    "a#p1",
+		//only the separator marks a sub queue
+		"mail.p3":    "mail.p3",
+		"mail.p3#p2": "mail.p3",
+	} {
+		if ok := assert.Equal(t, base, disqueBase(queue), queue); !ok {
+			t.Fatal()
+		}
+	}
+}
+
+func TestBrokersAdmin(t *testing.T) {
+	for _, broker := range []Broker{&amqpBroker{}, &disqueBroker{}} {
+		if _, ok := broker.(Admin); !ok {
+			t.Fatalf("%T doesn't implement Admin", broker)
+		}
+	}
+}
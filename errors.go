@@ -0,0 +1,74 @@
+package wfe
+
+import (
+	"fmt"
+)
+
+//TaskError is returned by Result.Get when a task fails. It holds the error details recorded by the worker, and
+//can be inspected with errors.As
+//
+//	var te *wfe.TaskError
+//	if _, err := result.Get(); errors.As(err, &te) {
+//		log.Println(te.Type, te.Code, te.Retryable)
+//	}
+//
+//A task can also return (or panic with) a *TaskError to control the code and retryable flag of the failure. Any other
+//error that implements `Code() string` or `Retryable() bool` has those values recorded as well.
+type TaskError struct {
+	//Type name of the error (or the panic value) raised by the task, e.g `*errors.errorString`
+	Type string
+	//Code optional error code
+	Code string
+	//Message error message
+	Message string
+	//Retryable notates that the task may succeed if it's called again
+	Retryable bool
+	//Stack trace of the worker go routine, only set if the task paniced
+	Stack string
+}
+
+type errorCoder interface {
+	Code() string
+}
+
+type retryableError interface {
+	Retryable() bool
+}
+
+func (e *TaskError) Error() string {
+	return e.Message
+}
+
+//newTaskError builds a TaskError out of an error returned by a task, or a recovered panic value.
+func newTaskError(err interface{}, stack []byte) *TaskError {
+	if te, ok := err.(*TaskError); ok {
+		c := *te
+		if c.Type == "" {
+			c.Type = fmt.Sprintf("%T", te)
+		}
+		if c.Stack == "" {
+			c.Stack = string(stack)
+		}
+		return &c
+	}
+
+	te := &TaskError{
+		Type:    fmt.Sprintf("%T", err),
+		Message: fmt.Sprintf("%v", err),
+		Stack:   string(stack),
+	}
+
+	if e, ok := err.(error); ok {
+		te.Message = e.Error()
+	}
+
+	if e, ok := err.(errorCoder); ok {
+		te.Code = e.Code()
+	}
+
+	if e, ok := err.(retryableError); ok {
+		te.Retryable = e.Retryable()
+	}
+
+	return te
+}
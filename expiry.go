@@ -0,0 +1,58 @@
+package wfe
+
+import (
+	"errors"
+	"time"
+)
+
+//ErrExpired the request expired before it was run
+var ErrExpired = errors.New("request expired")
+
+/*
+ExpiresAt sets the time after which the request is not run anymore. The brokers that support it drop the message
+once it's expired, the workers record a StateExpired response for the expired requests they still receive.
+
+	req := wfe.With(wfe.MustCall(Notify, user.ID), wfe.ExpiresAt(meeting.Start))
+*/
+func ExpiresAt(t time.Time) CallOption {
+	return func(r *requestImpl) {
+		r.ExpiresAt = t
+	}
+}
+
+//ExpiresIn sets the request to expire after the given duration, see ExpiresAt
+func ExpiresIn(d time.Duration) CallOption {
+	return func(r *requestImpl) {
+		r.ExpiresAt = time.Now().Add(d)
+	}
+}
+
+//TTL sets all the calls to the task to expire after the given duration, unless the call sets its own expiry
+//
+//	wfe.RegisterNamed("notify.push", Push, wfe.TTL(10*time.Minute))
+func TTL(d time.Duration) RegisterOption {
+	return func(f *function) {
+		f.ttl = d
+	}
+}
+
+//expire returns the request to dispatch and its expiry (zero if it never expires). A request with no explicit expiry
+//gets the registered task TTL on a copy, so the caller's request is left as is and gets a fresh TTL if applied again
+func (f *function) expire(req Request) (Request, time.Time) {
+	r, ok := req.(*requestImpl)
+	if !ok {
+		return req, time.Time{}
+	}
+
+	if r.ExpiresAt.IsZero() && f.ttl > 0 {
+		expiring := *r
+		expiring.ExpiresAt = time.Now().Add(f.ttl)
+		return &expiring, expiring.ExpiresAt
+	}
+
+	return r, r.ExpiresAt
+}
+
+func (r *requestImpl) expired(now time.Time) bool {
+	return !r.ExpiresAt.IsZero() && !now.Before(r.ExpiresAt)
+}
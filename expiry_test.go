@@ -0,0 +1,113 @@
+package wfe
+
+import (
+	"bytes"
+	"encoding/gob"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"testing"
+	"time"
+)
+
+func expiryAddTest(c *Context, a, b int) int {
+	return a + b
+}
+
+func TestHandleDeliveryExpired(t *testing.T) {
+	Register(expiryAddTest)
+
+	store := &testStore{}
+	eng := &Engine{store: store}
+
+	d := testDelivery{val: requestImpl{
+		Function:  "github.com/conictus/wfe.expiryAddTest",
+		Arguments: []interface{}{1, 2},
+		ExpiresAt: time.Now().Add(-time.Minute),
+	}}
+
+	d.On("ID").Return("1234")
+	d.On("Confirm").Return(nil)
+
+	store.On("Set", mock.MatchedBy(func(r *Response) bool {
+		return r.State == StateExpired && r.Error == ErrExpired.Error() && r.Result == nil
+	})).Return(nil)
+
+	if ok := assert.Equal(t, ErrExpired, eng.handleDelivery(&d)); !ok {
+		t.Fatal()
+	}
+
+	if ok := store.AssertExpectations(t); !ok {
+		t.Fatal()
+	}
+
+	if ok := d.AssertExpectations(t); !ok {
+		t.Fatal()
+	}
+}
+
+func TestClientApplyExpiry(t *testing.T) {
+	broker := &testBroker{}
+	store := &testStore{}
+
+	dispatcher := &testDispatcher{}
+	broker.On("Dispatcher").Return(dispatcher, nil)
+
+	client, err := newClient(broker, store)
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	RegisterNamed("expiry.add", expiryAddTest, TTL(time.Hour))
+
+	dispatcher.On("Dispatch", WorkQueueRoute, mock.MatchedBy(func(m *Message) bool {
+		ttl := time.Until(m.ExpiresAt)
+		return ttl > 59*time.Minute && ttl <= time.Hour && m.Content.(*requestImpl).ExpiresAt.Equal(m.ExpiresAt)
+	})).Return("1234", nil).Once()
+
+	req := MustCall(expiryAddTest, 1, 2)
+	if _, err := client.Apply(req); err != nil {
+		t.Fatal(err)
+	}
+
+	//the TTL is set on the dispatched message, not on the request of the caller
+	if ok := assert.True(t, req.(*requestImpl).ExpiresAt.IsZero()); !ok {
+		t.Fatal()
+	}
+
+	_, err = client.Apply(With(MustCall(expiryAddTest, 1, 2), ExpiresAt(time.Now().Add(-time.Second))))
+	if ok := assert.Equal(t, ErrExpired, err); !ok {
+		t.Fatal()
+	}
+
+	if ok := dispatcher.AssertExpectations(t); !ok {
+		t.Fatal()
+	}
+}
+
+func TestChainExpiresAt(t *testing.T) {
+	Register(expiryAddTest)
+
+	expires := time.Now().Add(time.Hour).UTC()
+	partial := With(MustPartialCall(expiryAddTest, 1), ExpiresAt(expires))
+
+	//the chain steps travel through the broker, so the expiry must survive the encoding
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(partial); err != nil {
+		t.Fatal(err)
+	}
+
+	var step requestImpl
+	if err := gob.NewDecoder(&buffer).Decode(&step); err != nil {
+		t.Fatal(err)
+	}
+
+	step.Append(2)
+	req, err := step.Request()
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.True(t, expires.Equal(req.(*requestImpl).ExpiresAt)); !ok {
+		t.Fatal()
+	}
+}
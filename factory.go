@@ -3,17 +3,24 @@ package wfe
 import (
 	"fmt"
 	"net/url"
+	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 var (
 	brokers  = make(map[string]BrokerFactory)
 	stores   = make(map[string]ResultStoreFactory)
 	graphers = make(map[string]GraphBackendFactory)
+	blobs    = make(map[string]BlobStoreFactory)
 
-	bm sync.Mutex
-	sm sync.Mutex
-	gm sync.Mutex
+	bm  sync.Mutex
+	sm  sync.Mutex
+	gm  sync.Mutex
+	blm sync.Mutex
+
+	//brokerNext first broker URL of the next GetBroker, if BrokerRoundRobin is set
+	brokerNext uint32
 )
 
 //BrokerFactory function type
@@ -25,17 +32,49 @@ type ResultStoreFactory func(u *url.URL) (ResultStore, error)
 //GraphBackend factory function type
 type GraphBackendFactory func(u *url.URL) (GraphBackend, error)
 
+//BlobStoreFactory function type
+type BlobStoreFactory func(u *url.URL) (BlobStore, error)
+
 //Options is used to configure both the Engine and the Client instances. It specifies the broker and the result store
 //to use
 type Options struct {
-	//Broker URL `amqp://localhost:5672`
+	//Broker URL `amqp://localhost:5672`. Many URLs can be separated by commas, see Brokers
 	Broker string
 
+	//Brokers URLs of the broker nodes, in addition to Broker. GetBroker connects to the first reachable node, and the
+	//dispatchers and consumers fail over to the next node if the current node is lost
+	Brokers []string
+
+	//BrokerRoundRobin if set, each GetBroker starts with the next broker URL instead of the first, to spread the
+	//clients over the nodes
+	BrokerRoundRobin bool
+
 	//Store URL `redis://localhost:6379?keep=30`
 	Store string
 
 	//Graph backend URL
 	Graph string
+
+	//Blob store URL `file:///var/lib/wfe/blobs?keep=86400`. If set, the arguments and results larger than
+	//BlobThreshold are offloaded to the blob store. Clients and workers must use the same blob store.
+	Blob string
+
+	//BlobThreshold size in bytes above which payloads are offloaded, DefaultBlobThreshold if not set
+	BlobThreshold int
+
+	//Keyring if set, the requests and results are signed (and optionally encrypted) and the unsigned ones are
+	//rejected. Clients and workers must share the keys.
+	Keyring *Keyring
+
+	//RequeueVersionMismatch if set, a worker puts back on the queue the requests of a task version it doesn't
+	//implement (if the broker supports it) so a worker of the matching version can run them. Otherwise the request
+	//fails with ErrVersionMismatch. The worker waits before requeueing a request, longer on each redelivery.
+	RequeueVersionMismatch bool
+
+	//RequeueLimit number of times a request is requeued before it fails with ErrVersionMismatch, DefaultRequeueLimit
+	//if not set. Only the brokers that count the redeliveries (disque, AMQP quorum queues) enforce it, the requests
+	//on the other brokers are requeued (slowly) until a worker of their version runs them
+	RequeueLimit int
 }
 
 /*
@@ -71,11 +110,73 @@ func RegisterGraphBackend(scheme string, factory GraphBackendFactory) {
 	graphers[scheme] = factory
 }
 
-//GetBroker gets a new instance of the broker according to the broker url
+//RegisterBlobStore is used to register a blob store factory. WFE package implements the `file` blob store
+func RegisterBlobStore(scheme string, factory BlobStoreFactory) {
+	blm.Lock()
+	defer blm.Unlock()
+
+	blobs[scheme] = factory
+}
+
+func (o *Options) requeueLimit() int {
+	if o.RequeueLimit > 0 {
+		return o.RequeueLimit
+	}
+
+	return DefaultRequeueLimit
+}
+
+//brokerURLs returns the URLs of Broker and Brokers. Only the parts of Broker with a scheme start a new URL, so the
+//URLs listing many hosts like `disque://node1:7711,node2:7711` are kept
+func (o *Options) brokerURLs() []string {
+	var urls []string
+	for _, part := range strings.Split(o.Broker, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		if !strings.Contains(part, "://") && len(urls) > 0 {
+			urls[len(urls)-1] += "," + part
+			continue
+		}
+
+		urls = append(urls, part)
+	}
+
+	return append(urls, o.Brokers...)
+}
+
+/*
+GetBroker gets a new instance of the broker according to the broker url. If many broker URLs are set, it connects to
+the first reachable node (starting with the next URL on each call if BrokerRoundRobin is set), and returns a broker
+that fails over to the other nodes.
+
+	o := &wfe.Options{
+		Broker: "amqp://rabbit1:5672,amqp://rabbit2:5672",
+	}
+*/
 func (o *Options) GetBroker() (Broker, error) {
-	u, err := url.Parse(o.Broker)
+	urls := o.brokerURLs()
+	switch len(urls) {
+	case 0:
+		return nil, fmt.Errorf("broker url is not set")
+	case 1:
+		return getBroker(urls[0])
+	}
+
+	start := 0
+	if o.BrokerRoundRobin {
+		start = int(atomic.AddUint32(&brokerNext, 1)-1) % len(urls)
+	}
+
+	return newFailoverBroker(urls, start)
+}
+
+func getBroker(raw string) (Broker, error) {
+	u, err := url.Parse(raw)
 	if err != nil {
-		log.Errorf("failed to parse broker url: %s", o.Broker)
+		log.Errorf("failed to parse broker url: %s", raw)
 		return nil, err
 	}
 
@@ -134,3 +235,26 @@ func (o *Options) GetGraphBackend() (GraphBackend, error) {
 
 	return factory(u)
 }
+
+//GetBlobStore gets a new instance of the blob store according to the blob url, or nil if no blob store is set
+func (o *Options) GetBlobStore() (BlobStore, error) {
+	if o.Blob == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(o.Blob)
+	if err != nil {
+		log.Errorf("failed to parse blob store url: %s", o.Blob)
+		return nil, err
+	}
+
+	blm.Lock()
+	defer blm.Unlock()
+
+	factory, ok := blobs[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("unknown blob store %s", u.Scheme)
+	}
+
+	return factory(u)
+}
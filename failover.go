@@ -0,0 +1,418 @@
+package wfe
+
+import (
+	"errors"
+	"fmt"
+	"github.com/streadway/amqp"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	//failoverRetry delay before a consumer subscribes again to the same node, and the first delay before a lost node
+	//is failed over again when no other node was reachable
+	failoverRetry = time.Second
+	//failoverRetryMax the longest delay between two fail over attempts of a lost node
+	failoverRetryMax = 30 * time.Second
+)
+
+//failoverBroker connects to one of many broker nodes, and replaces the current node by the next reachable one when
+//it's lost
+type failoverBroker struct {
+	urls []string
+
+	m      sync.Mutex
+	broker Broker
+	index  int
+	closed bool
+}
+
+type failoverDispatcher struct {
+	broker *failoverBroker
+
+	m          sync.Mutex
+	from       Broker
+	dispatcher Dispatcher
+}
+
+type failoverConsumer struct {
+	broker *failoverBroker
+	o      *RouteOptions
+
+	m        sync.Mutex
+	consumer Consumer
+	closed   bool
+}
+
+func newFailoverBroker(urls []string, start int) (*failoverBroker, error) {
+	f := &failoverBroker{urls: urls}
+	broker, index, err := f.connect(start)
+	if err != nil {
+		return nil, err
+	}
+
+	f.use(broker, index)
+	return f, nil
+}
+
+//connect returns the first reachable node, starting with the url at start
+func (f *failoverBroker) connect(start int) (Broker, int, error) {
+	var errs []string
+	for i := 0; i < len(f.urls); i++ {
+		index := (start + i) % len(f.urls)
+		broker, err := getBroker(f.urls[index])
+		if err == nil {
+			return broker, index, nil
+		}
+
+		log.Errorf("Failed to connect to broker '%s': %s", f.urls[index], err)
+		errs = append(errs, err.Error())
+	}
+
+	return nil, 0, fmt.Errorf("no broker is reachable: %s", strings.Join(errs, ", "))
+}
+
+//use sets the current node, and watches it if it can tell it's lost. Must be called with the lock held (or before the
+//broker is shared)
+func (f *failoverBroker) use(broker Broker, index int) {
+	f.broker = broker
+	f.index = index
+
+	if notifier, ok := broker.(DownNotifier); ok {
+		go func() {
+			<-notifier.Down()
+
+			backoff := failoverRetry
+			for {
+				_, err := f.failover(broker)
+				if err == nil || err == ErrBrokerClosed {
+					return
+				}
+
+				log.Errorf("Failed to fail over broker '%s': %s", f.urls[index], err)
+				time.Sleep(backoff)
+				if backoff *= 2; backoff > failoverRetryMax {
+					backoff = failoverRetryMax
+				}
+			}
+		}()
+	}
+}
+
+func (f *failoverBroker) current() (Broker, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	if f.closed {
+		return nil, ErrBrokerClosed
+	}
+
+	return f.broker, nil
+}
+
+//failover replaces the failed node by the next reachable node. The failed node is closed, so its consumers stop and
+//subscribe again to the new node. The nodes are dialed without the lock, so the current node is still served while
+//the next one is reached.
+func (f *failoverBroker) failover(failed Broker) (Broker, error) {
+	f.m.Lock()
+	if f.closed {
+		f.m.Unlock()
+		return nil, ErrBrokerClosed
+	}
+
+	if f.broker != failed {
+		//already replaced
+		defer f.m.Unlock()
+		return f.broker, nil
+	}
+
+	start := f.index + 1
+	f.m.Unlock()
+
+	broker, index, err := f.connect(start)
+	if err != nil {
+		return nil, err
+	}
+
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	if f.closed {
+		broker.Close()
+		return nil, ErrBrokerClosed
+	}
+
+	if f.broker != failed {
+		//replaced while dialing
+		broker.Close()
+		return f.broker, nil
+	}
+
+	log.Warningf("Broker '%s' failed over to '%s'", f.urls[f.index], f.urls[index])
+	failed.Close()
+	f.use(broker, index)
+
+	return broker, nil
+}
+
+func (f *failoverBroker) Close() error {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	f.closed = true
+	return f.broker.Close()
+}
+
+func (f *failoverBroker) Dispatcher() (Dispatcher, error) {
+	d := &failoverDispatcher{broker: f}
+	if _, _, err := d.get(); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+func (f *failoverBroker) Consumer(o *RouteOptions) (Consumer, error) {
+	broker, err := f.current()
+	if err != nil {
+		return nil, err
+	}
+
+	consumer, err := broker.Consumer(o)
+	if err != nil {
+		return nil, err
+	}
+
+	return &failoverConsumer{
+		broker:   f,
+		o:        o,
+		consumer: consumer,
+	}, nil
+}
+
+//isConnectionError reports if a dispatch failed because the broker node is not reachable, other errors are not
+//failed over
+func isConnectionError(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, ErrDisconnected) ||
+		errors.Is(err, ErrBrokerClosed) ||
+		errors.Is(err, amqp.ErrClosed) ||
+		errors.Is(err, io.EOF) ||
+		errors.As(err, &netErr)
+}
+
+//get returns the dispatcher of the current node
+func (d *failoverDispatcher) get() (Broker, Dispatcher, error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	broker, err := d.broker.current()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if broker != d.from {
+		dispatcher, err := broker.Dispatcher()
+		if err != nil {
+			return broker, nil, err
+		}
+
+		if d.dispatcher != nil {
+			d.dispatcher.Close()
+		}
+
+		d.from, d.dispatcher = broker, dispatcher
+	}
+
+	return broker, d.dispatcher, nil
+}
+
+//Dispatch the message to the current node, the message is dispatched again to the next node if the current node
+//is not reachable
+func (d *failoverDispatcher) Dispatch(o *RouteOptions, msg *Message) (string, error) {
+	var err error
+	for attempt := 0; attempt < len(d.broker.urls); attempt++ {
+		var broker Broker
+		var dispatcher Dispatcher
+		if broker, dispatcher, err = d.get(); err == nil {
+			var id string
+			if id, err = dispatcher.Dispatch(o, msg); err == nil || !isConnectionError(err) {
+				return id, err
+			}
+		} else if broker == nil || !isConnectionError(err) {
+			return "", err
+		}
+
+		log.Warningf("Failed to dispatch message: %s", err)
+		if _, err := d.broker.failover(broker); err != nil {
+			return "", err
+		}
+	}
+
+	return "", err
+}
+
+func (d *failoverDispatcher) Close() error {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	if d.dispatcher == nil {
+		return nil
+	}
+
+	return d.dispatcher.Close()
+}
+
+//subscribe consumes the route again on the current node
+func (c *failoverConsumer) subscribe() (<-chan Delivery, error) {
+	broker, err := c.broker.current()
+	if err != nil {
+		return nil, err
+	}
+
+	consumer, err := broker.Consumer(c.o)
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries, err := consumer.Consume()
+	if err != nil {
+		consumer.Close()
+		return nil, err
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.closed {
+		consumer.Close()
+		return nil, ErrBrokerClosed
+	}
+
+	c.consumer.Close()
+	c.consumer = consumer
+	return deliveries, nil
+}
+
+func (c *failoverConsumer) isClosed() bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	return c.closed
+}
+
+//Consume the route deliveries, the consumer subscribes again to the new node after a fail over. The deliveries
+//channel is only closed when the consumer (or the broker) is closed
+func (c *failoverConsumer) Consume() (<-chan Delivery, error) {
+	c.m.Lock()
+	consumer := c.consumer
+	c.m.Unlock()
+
+	deliveries, err := consumer.Consume()
+	if err != nil {
+		return nil, err
+	}
+
+	feeder := make(chan Delivery)
+	go func() {
+		defer close(feeder)
+		for {
+			for delivery := range deliveries {
+				feeder <- delivery
+			}
+
+			for {
+				time.Sleep(failoverRetry)
+				if c.isClosed() {
+					return
+				}
+
+				var err error
+				if deliveries, err = c.subscribe(); err == nil {
+					break
+				} else if err == ErrBrokerClosed {
+					return
+				}
+
+				log.Errorf("Failed to consume queue '%s': %s", c.o.Queue, err)
+			}
+		}
+	}()
+
+	return feeder, nil
+}
+
+func (c *failoverConsumer) Close() error {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.closed = true
+	if c.consumer == nil {
+		return nil
+	}
+
+	return c.consumer.Close()
+}
+
+//admin returns the Admin of the current node
+func (f *failoverBroker) admin() (Admin, error) {
+	broker, err := f.current()
+	if err != nil {
+		return nil, err
+	}
+
+	admin, ok := broker.(Admin)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+
+	return admin, nil
+}
+
+func (f *failoverBroker) QueueLength(queue string) (int, error) {
+	admin, err := f.admin()
+	if err != nil {
+		return 0, err
+	}
+
+	return admin.QueueLength(queue)
+}
+
+func (f *failoverBroker) Purge(queue string) (int, error) {
+	admin, err := f.admin()
+	if err != nil {
+		return 0, err
+	}
+
+	return admin.Purge(queue)
+}
+
+func (f *failoverBroker) ListQueues() ([]string, error) {
+	admin, err := f.admin()
+	if err != nil {
+		return nil, err
+	}
+
+	return admin.ListQueues()
+}
+
+func (f *failoverBroker) DeleteQueue(queue string) error {
+	admin, err := f.admin()
+	if err != nil {
+		return err
+	}
+
+	return admin.DeleteQueue(queue)
+}
+
+func (f *failoverBroker) Peek(queue string, n int) ([]Request, error) {
+	admin, err := f.admin()
+	if err != nil {
+		return nil, err
+	}
+
+	return admin.Peek(queue, n)
+}
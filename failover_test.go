@@ -0,0 +1,279 @@
+package wfe
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	failoverTestBrokers = map[string]Broker{}
+	failoverTestM       sync.Mutex
+)
+
+//failoverTestNode registers (or removes if nil) a reachable test node
+func failoverTestNode(host string, broker Broker) {
+	failoverTestM.Lock()
+	defer failoverTestM.Unlock()
+
+	if broker == nil {
+		delete(failoverTestBrokers, host)
+		return
+	}
+
+	failoverTestBrokers[host] = broker
+}
+
+type failoverTestDownBroker struct {
+	testBroker
+	down chan struct{}
+}
+
+func (b *failoverTestDownBroker) Down() <-chan struct{} {
+	return b.down
+}
+
+func init() {
+	RegisterBroker("failover", func(u *url.URL) (Broker, error) {
+		failoverTestM.Lock()
+		defer failoverTestM.Unlock()
+
+		broker, ok := failoverTestBrokers[u.Host]
+		if !ok {
+			return nil, errors.New("connection refused")
+		}
+
+		return broker, nil
+	})
+}
+
+func TestBrokerURLs(t *testing.T) {
+	o := &Options{
+		Broker:  "amqp://rabbit1:5672, amqp://rabbit2:5672,disque://node1:7711,node2:7711",
+		Brokers: []string{"amqp://rabbit3:5672"},
+	}
+
+	expected := []string{
+		"amqp://rabbit1:5672",
+		"amqp://rabbit2:5672",
+		"disque://node1:7711,node2:7711",
+		"amqp://rabbit3:5672",
+	}
+
+	if ok := assert.Equal(t, expected, o.brokerURLs()); !ok {
+		t.Fatal()
+	}
+}
+
+func TestFailoverDispatch(t *testing.T) {
+	first, second := &testBroker{}, &testBroker{}
+	failoverTestNode("first", first)
+	failoverTestNode("second", second)
+
+	firstDispatcher, secondDispatcher := &testDispatcher{}, &testDispatcher{}
+	first.On("Dispatcher").Return(firstDispatcher, nil)
+	first.On("Close").Return(nil)
+	second.On("Dispatcher").Return(secondDispatcher, nil)
+
+	o := &Options{
+		Broker: "failover://down,failover://first,failover://second",
+	}
+
+	broker, err := o.GetBroker()
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	dispatcher, err := broker.Dispatcher()
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	msg := &Message{Content: MustCall(wfeAddTest, 1, 2)}
+	firstDispatcher.On("Dispatch", WorkQueueRoute, msg).Return("", ErrDisconnected)
+	firstDispatcher.On("Close").Return(nil)
+	secondDispatcher.On("Dispatch", WorkQueueRoute, msg).Return("1234", nil)
+
+	id, err := dispatcher.Dispatch(WorkQueueRoute, msg)
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, "1234", id); !ok {
+		t.Fatal()
+	}
+
+	//the failed node is closed
+	if ok := first.AssertExpectations(t); !ok {
+		t.Fatal()
+	}
+
+	//message errors are not failed over
+	unroutable := &Message{Content: MustCall(wfeAddTest, 3, 4)}
+	secondDispatcher.On("Dispatch", WorkQueueRoute, unroutable).Return("", ErrUnroutable).Once()
+	if _, err := dispatcher.Dispatch(WorkQueueRoute, unroutable); err != ErrUnroutable {
+		t.Fatal(err)
+	}
+
+	if ok := secondDispatcher.AssertExpectations(t); !ok {
+		t.Fatal()
+	}
+}
+
+func TestFailoverDownRetry(t *testing.T) {
+	lost, spare := &failoverTestDownBroker{down: make(chan struct{})}, &testBroker{}
+	lost.On("Close").Return(nil)
+	spare.On("Close").Return(nil)
+	failoverTestNode("lost", lost)
+
+	o := &Options{
+		Broker: "failover://lost,failover://spare",
+	}
+
+	broker, err := o.GetBroker()
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	//no other node is reachable when the node is lost, so the fail over is retried until one is
+	failoverTestNode("lost", nil)
+	close(lost.down)
+	time.Sleep(100 * time.Millisecond)
+	failoverTestNode("spare", spare)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		current, err := broker.(*failoverBroker).current()
+		if ok := assert.Nil(t, err); !ok {
+			t.Fatal()
+		}
+
+		if current == spare {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal("the lost node was not failed over")
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if ok := assert.Nil(t, broker.Close()); !ok {
+		t.Fatal()
+	}
+
+	if ok := lost.AssertExpectations(t); !ok {
+		t.Fatal()
+	}
+
+	if ok := spare.AssertExpectations(t); !ok {
+		t.Fatal()
+	}
+}
+
+func TestFailoverConsume(t *testing.T) {
+	route := &RouteOptions{Queue: "wfe"}
+	first, second := &failoverTestDownBroker{down: make(chan struct{})}, &testBroker{}
+	firstConsumer, secondConsumer := &testConsumer{}, &testConsumer{}
+	firstDeliveries, secondDeliveries := make(chan Delivery), make(chan Delivery, 1)
+
+	first.On("Consumer", route).Return(firstConsumer, nil)
+	first.On("Close").Return(nil)
+	firstConsumer.On("Consume").Return((<-chan Delivery)(firstDeliveries), nil)
+	firstConsumer.On("Close").Return(nil)
+
+	second.On("Consumer", route).Return(secondConsumer, nil)
+	second.On("Close").Return(nil)
+	secondConsumer.On("Consume").Return((<-chan Delivery)(secondDeliveries), nil)
+	secondConsumer.On("Close").Return(nil)
+
+	failoverTestNode("first", first)
+	failoverTestNode("second", second)
+	defer failoverTestNode("first", nil)
+	defer failoverTestNode("second", nil)
+
+	o := &Options{
+		Broker: "failover://first,failover://second",
+	}
+
+	broker, err := o.GetBroker()
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	consumer, err := broker.Consumer(route)
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	deliveries, err := consumer.Consume()
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	receive := func() Delivery {
+		select {
+		case delivery := <-deliveries:
+			return delivery
+		case <-time.After(5 * time.Second):
+			t.Fatal("no delivery received")
+		}
+
+		return nil
+	}
+
+	delivery := &testDelivery{}
+	firstDeliveries <- delivery
+	if ok := assert.True(t, delivery == receive()); !ok {
+		t.Fatal()
+	}
+
+	//the first node goes down, which stops its consumers
+	failoverTestNode("first", nil)
+	close(first.down)
+	close(firstDeliveries)
+
+	//the deliveries continue from the next node
+	delivery = &testDelivery{}
+	secondDeliveries <- delivery
+	if ok := assert.True(t, delivery == receive()); !ok {
+		t.Fatal()
+	}
+
+	//the deliveries channel is closed once the consumer is closed
+	if ok := assert.Nil(t, consumer.Close()); !ok {
+		t.Fatal()
+	}
+	close(secondDeliveries)
+
+	select {
+	case _, ok := <-deliveries:
+		if ok {
+			t.Fatal("unexpected delivery")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("deliveries channel is not closed")
+	}
+
+	if ok := assert.Nil(t, broker.Close()); !ok {
+		t.Fatal()
+	}
+
+	if ok := first.AssertExpectations(t); !ok {
+		t.Fatal()
+	}
+
+	if ok := second.AssertExpectations(t); !ok {
+		t.Fatal()
+	}
+
+	if ok := firstConsumer.AssertExpectations(t); !ok {
+		t.Fatal()
+	}
+
+	if ok := secondConsumer.AssertExpectations(t); !ok {
+		t.Fatal()
+	}
+}
@@ -0,0 +1,231 @@
+package wfe
+
+import (
+	"fmt"
+	"github.com/pborman/uuid"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	fileBlobCleanupInterval = time.Minute
+)
+
+var (
+	//fileBlobCleaners the cleaners of the blob directories, shared by all the stores of a directory
+	fileBlobCleaners = make(map[string]*fileBlobCleaner)
+	fbm              sync.Mutex
+)
+
+type fileBlobStore struct {
+	dir     string
+	keep    int
+	cleaner *fileBlobCleaner
+	close   sync.Once
+}
+
+//fileBlobCleaner deletes the expired blobs of a directory until the last store of the directory is closed
+type fileBlobCleaner struct {
+	dir  string
+	refs int
+	done chan struct{}
+}
+
+func init() {
+	//file:///var/lib/wfe/blobs?keep=86400
+	RegisterBlobStore("file", func(u *url.URL) (BlobStore, error) {
+		keep, err := parseInt(u.Query().Get("keep"), 86400)
+		if err != nil {
+			return nil, err
+		}
+
+		return NewFileBlobStore(u.Host+u.Path, keep)
+	})
+}
+
+/*
+NewFileBlobStore creates a blob store in a directory, that must be shared by the clients and the workers (for example
+an NFS mount). Blobs are kept for `keep` seconds (forever if keep is 0) unless an expiry time is given on Put, and the
+expired blobs are deleted periodically by a single cleaner per directory. The store must be closed once it's not used.
+*/
+func NewFileBlobStore(dir string, keep int) (BlobStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	cleaner, err := startFileBlobCleaner(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileBlobStore{
+		dir:     dir,
+		keep:    keep,
+		cleaner: cleaner,
+	}, nil
+}
+
+//startFileBlobCleaner returns the cleaner of the directory, it's started by the first store of the directory
+func startFileBlobCleaner(dir string) (*fileBlobCleaner, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	fbm.Lock()
+	defer fbm.Unlock()
+
+	cleaner, ok := fileBlobCleaners[abs]
+	if !ok {
+		cleaner = &fileBlobCleaner{
+			dir:  abs,
+			done: make(chan struct{}),
+		}
+		fileBlobCleaners[abs] = cleaner
+		go cleaner.run()
+	}
+
+	cleaner.refs++
+	return cleaner, nil
+}
+
+//release stops the cleaner once all the stores of the directory are closed
+func (c *fileBlobCleaner) release() {
+	fbm.Lock()
+	defer fbm.Unlock()
+
+	if c.refs--; c.refs > 0 {
+		return
+	}
+
+	delete(fileBlobCleaners, c.dir)
+	close(c.done)
+}
+
+func (c *fileBlobCleaner) run() {
+	ticker := time.NewTicker(fileBlobCleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := expireBlobs(c.dir, time.Now()); err != nil {
+				log.Errorf("Failed to delete expired blobs: %s", err)
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+//path of a reference, the reference is the expiry time followed by a random id so the cleanup doesn't need an index
+func (s *fileBlobStore) path(ref string) (string, error) {
+	if ref == "" || strings.ContainsAny(ref, `/\`) || ref[0] == '.' {
+		return "", fmt.Errorf("invalid blob reference '%s'", ref)
+	}
+
+	return filepath.Join(s.dir, ref), nil
+}
+
+func (s *fileBlobStore) Put(data []byte, expires time.Time) (string, error) {
+	if expires.IsZero() && s.keep > 0 {
+		expires = time.Now().Add(time.Duration(s.keep) * time.Second)
+	}
+
+	var at int64
+	if !expires.IsZero() {
+		at = expires.Unix()
+	}
+
+	ref := fmt.Sprintf("%d-%s", at, uuid.New())
+	path, _ := s.path(ref)
+
+	//write to a temporary file first, so a reader never sees a partial blob
+	tmp, err := ioutil.TempFile(s.dir, ".blob")
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+
+	return ref, nil
+}
+
+func (s *fileBlobStore) Get(ref string) ([]byte, error) {
+	path, err := s.path(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadFile(path)
+}
+
+func (s *fileBlobStore) Delete(ref string) error {
+	path, err := s.path(ref)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+//expire deletes the blobs that expired before now
+func (s *fileBlobStore) expire(now time.Time) error {
+	return expireBlobs(s.dir, now)
+}
+
+func expireBlobs(dir string, now time.Time) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		i := strings.IndexByte(name, '-')
+		if entry.IsDir() || i <= 0 {
+			continue
+		}
+
+		at, err := strconv.ParseInt(name[:i], 10, 64)
+		if err != nil || at == 0 || at > now.Unix() {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+			log.Errorf("Failed to delete expired blob '%s': %s", name, err)
+		}
+	}
+
+	return nil
+}
+
+//Close releases the cleaner of the directory, the cleanup stops when the last store of the directory is closed
+func (s *fileBlobStore) Close() error {
+	s.close.Do(s.cleaner.release)
+	return nil
+}
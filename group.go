@@ -19,11 +19,17 @@ type GroupResult interface {
 
 	//Count gets number of parallel tasks in the group
 	Count() int
+
+	//Results waits for all the tasks of the group and returns their results in order. It fails with the error of the
+	//first failed task.
+	Results() ([]interface{}, error)
 }
 
 type groupResultImpl struct {
 	Result
-	store ResultStore
+	store   ResultStore
+	blobs   *offloader
+	keyring *Keyring
 }
 
 func (g *groupResultImpl) get() ([]string, error) {
@@ -55,11 +61,41 @@ func (g *groupResultImpl) ResultOf(i int) (Result, error) {
 	}
 
 	return &resultImpl{
-		id:    ids[i],
-		store: g.store,
+		id:      ids[i],
+		store:   g.store,
+		blobs:   g.blobs,
+		keyring: g.keyring,
 	}, nil
 }
 
+func (g *groupResultImpl) Results() ([]interface{}, error) {
+	ids, err := g.get()
+	if err != nil {
+		return nil, err
+	}
+
+	responses, err := GetMany(g.store, ids, DefaultTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]interface{}, len(responses))
+	for i, response := range responses {
+		if err := g.keyring.openResponse(response); err != nil {
+			return nil, err
+		}
+		if err := response.Err(); err != nil {
+			return nil, err
+		}
+		if err := g.blobs.loadResponse(response); err != nil {
+			return nil, err
+		}
+		results[i] = response.Result
+	}
+
+	return results, nil
+}
+
 func group(c *Context, requests ...Request) []string {
 	results := make([]string, len(requests))
 	for i, request := range requests {
@@ -86,7 +122,9 @@ func (c *clientImpl) Group(requests ...Request) (GroupResult, error) {
 	}
 
 	return &groupResultImpl{
-		Result: result,
-		store:  c.store,
+		Result:  result,
+		store:   c.store,
+		blobs:   c.blobs,
+		keyring: c.keyring,
 	}, nil
 }
@@ -188,3 +188,29 @@ func TestGroupTaskPanic(t *testing.T) {
 
 	group(&ctx, r1, r2, r3)
 }
+
+func TestGroupResults(t *testing.T) {
+	store := &testStore{}
+	store.On("Get", "group-id", DefaultTimeout).Return(&Response{
+		UUID:   "group-id",
+		State:  StateSuccess,
+		Result: []string{"id-0", "id-1"},
+	}, nil)
+
+	store.On("Get", "id-0", DefaultTimeout).Return(&Response{UUID: "id-0", State: StateSuccess, Result: 3}, nil)
+	store.On("Get", "id-1", DefaultTimeout).Return(&Response{UUID: "id-1", State: StateSuccess, Result: 7}, nil)
+
+	g := &groupResultImpl{
+		Result: &resultImpl{id: "group-id", store: store},
+		store:  store,
+	}
+
+	results, err := g.Results()
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, []interface{}{3, 7}, results); !ok {
+		t.Fatal()
+	}
+}
@@ -0,0 +1,147 @@
+package wfe
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	//DefaultIdempotencyWindow how long an idempotency key is remembered if the task doesn't set a window
+	DefaultIdempotencyWindow = time.Hour
+
+	idempotencyRetries = 20
+	idempotencyBackoff = 100 * time.Millisecond
+	//idempotencyPending how long a key is claimed before it's bound to a task id, so a client that dies in between
+	//only holds the key for a short time. It's longer than the brokers dispatch (confirm) timeout
+	idempotencyPending = time.Minute
+)
+
+var (
+	//ErrIdempotencyPending a request with the same idempotency key is being dispatched by another client
+	ErrIdempotencyPending = errors.New("request with same idempotency key is pending")
+)
+
+//IdempotencyStore is implemented by result stores that can track idempotency keys. Clients use it to return the
+//result of the task that claimed a key instead of dispatching a duplicate, and workers use it to skip requests that
+//are redelivered by the broker after they are completed.
+type IdempotencyStore interface {
+	//Claim the key while the task is dispatched, it expires after the given pending time unless it's bound. If the key
+	//is already claimed it returns false, and the id of the task bound to the key (or an empty id if the task is not
+	//dispatched yet)
+	Claim(key string, pending time.Duration) (bool, string, error)
+
+	//Bind the task id to a claimed key, the key is then kept for the whole window
+	Bind(key string, id string, window time.Duration) error
+
+	//Release a claimed key, so the request can be dispatched again
+	Release(key string) error
+
+	//Completed checks if a response for the task id is already stored
+	Completed(id string) (bool, error)
+}
+
+type idempotentRequest interface {
+	IdempotencyKey() string
+}
+
+/*
+IdempotencyKey sets the idempotency key of a request. Applying a request with the same key as a request that is pending,
+or that finished within the idempotency window of the task, returns the result of the first request instead of running
+the task again. Requires a result store that implements IdempotencyStore.
+
+	req := wfe.With(wfe.MustCall(Charge, order.ID, order.Amount), wfe.IdempotencyKey("charge-"+order.ID))
+	result, err := client.Apply(req)
+*/
+func IdempotencyKey(key string) CallOption {
+	return func(r *requestImpl) {
+		r.Key = key
+	}
+}
+
+/*
+Idempotent makes all the calls to the task idempotent within the given window. Unless the request has an explicit
+IdempotencyKey, the key is derived from the task name and the arguments values.
+
+	wfe.RegisterNamed("billing.charge", Charge, wfe.Idempotent(24*time.Hour))
+
+A request created by PartialCall (a chain step or a chord callback) has no derived key until its arguments are
+complete: the key is derived when the request is built by PartialRequest.Request, from the appended results.
+*/
+func Idempotent(window time.Duration) RegisterOption {
+	return func(f *function) {
+		f.idempotent = true
+		f.window = window
+	}
+}
+
+func (r *requestImpl) IdempotencyKey() string {
+	return r.Key
+}
+
+//deriveKey derives an idempotency key from the task name and the JSON encoding of the arguments, so pointers are
+//hashed by the values they point to and maps by their sorted keys
+func deriveKey(name string, args interface{}) (string, error) {
+	data, err := json.Marshal(args)
+	if err != nil {
+		return "", fmt.Errorf("failed to derive idempotency key: %s", err)
+	}
+
+	h := sha1.New()
+	h.Write([]byte(name))
+	h.Write([]byte{0})
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (f *function) idempotencyWindow() time.Duration {
+	if f.window > 0 {
+		return f.window
+	}
+
+	return DefaultIdempotencyWindow
+}
+
+//applyIdempotent dispatches a request with an idempotency key, or returns the id of the task that claimed the key
+func applyIdempotent(store IdempotencyStore, key string, window time.Duration, dispatch func() (string, error)) (string, error) {
+	for i := 0; ; i++ {
+		claimed, id, err := store.Claim(key, idempotencyPending)
+		if err != nil {
+			return "", err
+		}
+
+		if claimed {
+			break
+		}
+
+		if id != "" {
+			log.Debugf("Request with idempotency key '%s' is already applied as '%s'", key, id)
+			return id, nil
+		}
+
+		if i == idempotencyRetries {
+			return "", ErrIdempotencyPending
+		}
+
+		time.Sleep(idempotencyBackoff)
+	}
+
+	id, err := dispatch()
+	if err != nil {
+		if err := store.Release(key); err != nil {
+			log.Errorf("Failed to release idempotency key '%s': %s", key, err)
+		}
+		return "", err
+	}
+
+	//the task is dispatched anyway, so its id is returned. The key expires (and can be applied again) after the
+	//pending time instead of the window
+	if err := store.Bind(key, id, window); err != nil {
+		log.Errorf("Failed to bind idempotency key '%s' to '%s': %s", key, id, err)
+	}
+
+	return id, nil
+}
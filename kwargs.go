@@ -0,0 +1,230 @@
+package wfe
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+const (
+	kwRequiredTag = "required"
+)
+
+var (
+	durationType = reflect.TypeOf(time.Duration(0))
+)
+
+type kwField struct {
+	index    int
+	name     string
+	required bool
+	def      string
+	hasDef   bool
+}
+
+//kwParam returns the struct parameter type of a keyword task. A keyword task accepts exactly one struct (or pointer
+//to struct) argument after the *Context
+func kwParam(fn reflect.Type) (reflect.Type, bool) {
+	if fn.NumIn() != 2 || fn.IsVariadic() {
+		return nil, false
+	}
+
+	t := fn.In(1)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	return fn.In(1), t.Kind() == reflect.Struct
+}
+
+//kwFields lists the exported fields of a keyword argument struct. The argument name is taken from the `json` tag
+//(or the field name), `wfe:"required"` marks the argument as required, and `default:"value"` sets a default value.
+func kwFields(t reflect.Type) []kwField {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	var fields []kwField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+
+		field := kwField{
+			index: i,
+			name:  f.Name,
+		}
+
+		if tag := strings.Split(f.Tag.Get("json"), ",")[0]; tag == "-" {
+			continue
+		} else if tag != "" {
+			field.name = tag
+		}
+
+		for _, opt := range strings.Split(f.Tag.Get("wfe"), ",") {
+			if opt == kwRequiredTag {
+				field.required = true
+			}
+		}
+
+		field.def, field.hasDef = f.Tag.Lookup("default")
+		fields = append(fields, field)
+	}
+
+	return fields
+}
+
+//parseDefault parses a `default` tag value into a value of type t
+func parseDefault(s string, t reflect.Type) (reflect.Value, error) {
+	v := reflect.New(t).Elem()
+	switch {
+	case t == durationType:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return v, err
+		}
+		v.SetInt(int64(d))
+	case t.Kind() == reflect.String:
+		v.SetString(s)
+	default:
+		if _, err := fmt.Sscan(s, v.Addr().Interface()); err != nil {
+			return v, err
+		}
+	}
+
+	return v, nil
+}
+
+//validateKwargs validates the named arguments against the keyword struct of the task at call time
+func validateKwargs(param reflect.Type, kwargs map[string]interface{}) error {
+	fields := make(map[string]reflect.Type)
+	st := param
+	if st.Kind() == reflect.Ptr {
+		st = st.Elem()
+	}
+
+	for _, f := range kwFields(param) {
+		fields[f.name] = st.Field(f.index).Type
+		if _, ok := kwargs[f.name]; f.required && !ok {
+			return fmt.Errorf("missing required argument '%s'", f.name)
+		}
+	}
+
+	for name, value := range kwargs {
+		t, ok := fields[name]
+		if !ok {
+			return fmt.Errorf("unknown argument '%s'", name)
+		}
+
+		if _, err := convertValue(value, t); err != nil {
+			return fmt.Errorf("%w for argument '%s': %s", ErrArgumentMismatch, name, err)
+		}
+	}
+
+	return nil
+}
+
+//buildKwargs builds the keyword struct of a task out of the named arguments. Missing arguments get their default
+//values and unknown arguments are ignored, so adding an optional field to the struct doesn't break queued requests.
+func buildKwargs(param reflect.Type, kwargs map[string]interface{}) (reflect.Value, error) {
+	st := param
+	if st.Kind() == reflect.Ptr {
+		st = st.Elem()
+	}
+
+	v := reflect.New(st).Elem()
+	for _, f := range kwFields(param) {
+		field := v.Field(f.index)
+		raw, ok := kwargs[f.name]
+		if !ok {
+			if f.required {
+				return v, fmt.Errorf("missing required argument '%s'", f.name)
+			}
+
+			if f.hasDef {
+				def, err := parseDefault(f.def, field.Type())
+				if err != nil {
+					return v, fmt.Errorf("invalid default value for argument '%s': %s", f.name, err)
+				}
+				field.Set(def)
+			}
+			continue
+		}
+
+		value, err := convertValue(raw, field.Type())
+		if err != nil {
+			return v, fmt.Errorf("%w for argument '%s': %s", ErrArgumentMismatch, f.name, err)
+		}
+		field.Set(value)
+	}
+
+	if param.Kind() == reflect.Ptr {
+		return v.Addr(), nil
+	}
+
+	return v, nil
+}
+
+/*
+CallKw creates a new `Request` for a keyword task. A keyword task accepts a single struct (or pointer to struct)
+argument, and the named arguments are mapped onto the struct fields by the worker.
+Example:
+	type ReportArgs struct {
+		Account string `json:"account" wfe:"required"`
+		Format  string `json:"format" default:"pdf"`
+		Pages   int    `json:"pages" default:"10"`
+	}
+
+	func Report(c *Context, args ReportArgs) string {
+		...
+	}
+
+	//from the caller
+	req, _ := wfe.CallKw(Report, map[string]interface{}{"account": "acme"})
+	client.Apply(req)
+
+The argument name is the `json` tag name of the field (or the field name). Arguments that are not provided get the value
+of the `default` tag (or the zero value) when the task runs, so new optional fields can be added to the struct without
+breaking queued requests. A call fails if an argument is unknown, a required argument is missing or if the types don't
+match.
+*/
+func CallKw(work interface{}, kwargs map[string]interface{}) (Request, error) {
+	fn := reflect.ValueOf(work)
+	if err := validateWorkFunc(fn); err != nil {
+		return nil, err
+	}
+
+	param, ok := kwParam(fn.Type())
+	if !ok {
+		return nil, fmt.Errorf("worker function doesn't accept keyword arguments")
+	}
+
+	if err := validateKwargs(param, kwargs); err != nil {
+		return nil, err
+	}
+
+	key, err := keyOf(fn, kwargs)
+	if err != nil {
+		return nil, err
+	}
+
+	return &requestImpl{
+		Function: nameOf(fn),
+		Version:  versionOf(fn),
+		Key:      key,
+		Keywords: kwargs,
+	}, nil
+}
+
+/*
+MustCallKw creates a new keyword call request, panics if the request can't be created.
+*/
+func MustCallKw(work interface{}, kwargs map[string]interface{}) Request {
+	req, err := CallKw(work, kwargs)
+	if err != nil {
+		panic(err)
+	}
+	return req
+}
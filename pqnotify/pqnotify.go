@@ -0,0 +1,82 @@
+/*
+Package pqnotify registers the `postgres` database driver, and a LISTEN/NOTIFY listener that wakes up the waiters of
+the wfe SQL result store as soon as a response is stored, instead of polling the results table.
+
+	import _ "github.com/conictus/wfe/pqnotify"
+*/
+package pqnotify
+
+import (
+	"github.com/conictus/wfe"
+	"github.com/lib/pq"
+	"github.com/op/go-logging"
+	"sync"
+	"time"
+)
+
+var (
+	log = logging.MustGetLogger("wfe")
+)
+
+type listener struct {
+	l      *pq.Listener
+	notify chan string
+	done   chan struct{}
+	close  sync.Once
+}
+
+func init() {
+	wfe.RegisterSQLListener("postgres", listen)
+}
+
+//listen subscribes to the notifications of the channel, the listener reconnects if the connection is lost
+func listen(dsn string, channel string) (wfe.SQLListener, error) {
+	l := pq.NewListener(dsn, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Errorf("Results listener error: %s", err)
+		}
+	})
+
+	if err := l.Listen(channel); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	n := &listener{
+		l:      l,
+		notify: make(chan string),
+		done:   make(chan struct{}),
+	}
+
+	go n.run()
+	return n, nil
+}
+
+func (n *listener) run() {
+	defer close(n.notify)
+	for notification := range n.l.Notify {
+		var id string
+		if notification != nil {
+			id = notification.Extra
+		}
+
+		select {
+		case n.notify <- id:
+		case <-n.done:
+			return
+		}
+	}
+}
+
+//Notify returns the ids of the stored responses, an empty id after a reconnect
+func (n *listener) Notify() <-chan string {
+	return n.notify
+}
+
+func (n *listener) Close() error {
+	n.close.Do(func() {
+		close(n.done)
+	})
+
+	return n.l.Close()
+}
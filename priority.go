@@ -0,0 +1,47 @@
+package wfe
+
+//MaxPriority is the highest priority of a request, requests have the lowest priority (0) by default
+const MaxPriority = 9
+
+/*
+Priority sets the priority of a single call, from 0 (the default) to MaxPriority. Requests of higher priority are
+consumed first from the queue, so interactive tasks don't wait behind batch jobs.
+
+	req := wfe.With(wfe.MustCall(Thumbnail, upload.ID), wfe.Priority(wfe.MaxPriority))
+
+The amqp broker only orders the messages of a queue by priority if it's declared with `max_priority` (see the broker
+url), the disque broker routes each priority to its own sub queue.
+*/
+func Priority(priority int) CallOption {
+	return func(r *requestImpl) {
+		p := clampPriority(priority)
+		r.Priority = &p
+	}
+}
+
+//DefaultPriority sets the priority of all the calls to the task, unless the call sets its own Priority
+func DefaultPriority(priority int) RegisterOption {
+	return func(f *function) {
+		f.priority = clampPriority(priority)
+	}
+}
+
+func clampPriority(priority int) int {
+	switch {
+	case priority < 0:
+		return 0
+	case priority > MaxPriority:
+		return MaxPriority
+	}
+
+	return priority
+}
+
+//priorityOf returns the priority a request to the task is dispatched with
+func (f *function) priorityOf(req Request) int {
+	if r, ok := req.(*requestImpl); ok && r.Priority != nil {
+		return *r.Priority
+	}
+
+	return f.priority
+}
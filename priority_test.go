@@ -0,0 +1,100 @@
+package wfe
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func priorityAddTest(c *Context, a, b int) int {
+	return a + b
+}
+
+func TestClientApplyPriority(t *testing.T) {
+	broker := &testBroker{}
+	store := &testStore{}
+
+	dispatcher := &testDispatcher{}
+	broker.On("Dispatcher").Return(dispatcher, nil)
+
+	client, err := newClient(broker, store)
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	RegisterNamed("priority.add", priorityAddTest, DefaultPriority(3))
+
+	for _, c := range []struct {
+		req      Request
+		priority int
+	}{
+		{MustCall(priorityAddTest, 1, 2), 3},
+		{With(MustCall(priorityAddTest, 3, 4), Priority(20)), MaxPriority},
+		{With(MustCall(priorityAddTest, 5, 6), Priority(0)), 0},
+	} {
+		dispatcher.On("Dispatch", WorkQueueRoute, &Message{Content: c.req, Priority: c.priority}).Return("1234", nil).Once()
+		if _, err := client.Apply(c.req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if ok := dispatcher.AssertExpectations(t); !ok {
+		t.Fatal()
+	}
+}
+
+func TestDisqueQueues(t *testing.T) {
+	if ok := assert.Equal(t, "wfe#p2", disqueQueue("wfe", 2)); !ok {
+		t.Fatal()
+	}
+
+	queues := disqueQueues("wfe")
+	if ok := assert.Equal(t, []string{"wfe#p9", "wfe#p8"}, queues[:2]); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, "wfe", queues[len(queues)-1]); !ok {
+		t.Fatal()
+	}
+
+	//the names that could collide with a sub queue are rejected
+	broker := &disqueBroker{}
+	_, err := broker.Dispatch(&RouteOptions{Queue: "reports#p2"}, &Message{Content: MustCall(priorityAddTest, 1, 2)})
+	if ok := assert.Error(t, err); !ok {
+		t.Fatal()
+	}
+
+	_, err = broker.Consumer(&RouteOptions{Queue: "wfe", Queues: []string{"reports#p2"}})
+	if ok := assert.Error(t, err); !ok {
+		t.Fatal()
+	}
+}
+
+func TestPartialPriority(t *testing.T) {
+	RegisterNamed("priority.add", priorityAddTest, DefaultPriority(3))
+
+	partial := With(MustPartialCall(priorityAddTest, 1), Priority(7)).(PartialRequest)
+
+	//partials travel through the broker (chains and chords), so the priority must survive a round trip
+	data, err := json.Marshal(partial)
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	var decoded requestImpl
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	if ok := assert.Equal(t, 7, *decoded.Priority); !ok {
+		t.Fatal()
+	}
+
+	partial.Append(2)
+	req := partial.MustRequest()
+
+	f, _ := registered("priority.add")
+	if ok := assert.Equal(t, 7, f.priorityOf(req)); !ok {
+		t.Fatal()
+	}
+}
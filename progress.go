@@ -0,0 +1,308 @@
+package wfe
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"sync"
+	"time"
+)
+
+const (
+	streamPollInterval = 500 * time.Millisecond
+)
+
+//Progress of a running task, as reported by Context.Progress
+type Progress struct {
+	Current int
+	Total   int
+	Meta    interface{}
+	Time    time.Time
+	//Seal holds the progress details if a keyring is used
+	Seal *sealed
+}
+
+//ProgressStore is implemented by result stores that can keep the progress and the partial results of running tasks
+type ProgressStore interface {
+	//SetProgress replaces the progress of the task id
+	SetProgress(id string, progress *Progress) error
+
+	//GetProgress gets the last progress of the task id, or ErrNotFound if no progress was reported
+	GetProgress(id string) (*Progress, error)
+
+	//Emit appends a partial result to the stream of the task id
+	Emit(id string, value interface{}) error
+
+	//Emitted gets the partial results of the task id, starting from offset
+	Emitted(id string, offset int) ([]interface{}, error)
+}
+
+/*
+ProgressResult is implemented by the results returned by the client, to follow a running task. The task progress and
+partial results are only available if the result store implements ProgressStore.
+
+	if p, ok := result.(wfe.ProgressResult); ok {
+		for value := range p.Stream(ctx) {
+			render(value)
+		}
+	}
+
+A group result follows all the tasks of the group at once, its tasks can also be followed one by one with ResultOf.
+The result of a chord is the result of its callback, the tasks of the chord can't be followed through it.
+*/
+type ProgressResult interface {
+	//Progress gets the last progress reported by the task, or ErrNotFound if the task didn't report any progress yet.
+	Progress() (*Progress, error)
+
+	//Stream receives the partial results emitted by the task. The channel is closed when the task is finished (and all
+	//its values are received) or when ctx is done. The store must also implement ResultPeeker to tell when the task is
+	//finished, otherwise the channel is closed right away.
+	Stream(ctx context.Context) <-chan interface{}
+}
+
+//streamValue wraps the emitted values so they can be gob encoded as interfaces
+type streamValue struct {
+	Value interface{}
+}
+
+func encodeProgress(v interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(v); err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+func decodeProgress(data []byte) (*Progress, error) {
+	var progress Progress
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&progress); err != nil {
+		return nil, err
+	}
+
+	return &progress, nil
+}
+
+func decodeStreamValue(data []byte) (interface{}, error) {
+	var value streamValue
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&value); err != nil {
+		return nil, err
+	}
+
+	return value.Value, nil
+}
+
+/*
+Progress reports the progress of the task, the client can read it with Result.Progress while the task is running.
+Progress is best effort, it's a NOOP if the result store doesn't implement ProgressStore.
+
+	for i, page := range pages {
+		render(page)
+		c.Progress(i+1, len(pages), page.Title)
+	}
+*/
+func (c *Context) Progress(current, total int, meta interface{}) {
+	store, ok := c.store.(ProgressStore)
+	if !ok {
+		return
+	}
+
+	progress := &Progress{
+		Current: current,
+		Total:   total,
+		Meta:    meta,
+		Time:    time.Now().UTC(),
+	}
+
+	if err := c.keyring.sealProgress(c.id, progress); err != nil {
+		log.Errorf("Failed to seal progress of task (%s): %s", c.id, err)
+		return
+	}
+
+	if err := store.SetProgress(c.id, progress); err != nil {
+		log.Errorf("Failed to set progress of task (%s): %s", c.id, err)
+	}
+}
+
+//Emit publishes a partial result of the task, the client can receive them with Result.Stream while the task is
+//running. Emit is a NOOP if the result store doesn't implement ProgressStore.
+func (c *Context) Emit(value interface{}) {
+	store, ok := c.store.(ProgressStore)
+	if !ok {
+		return
+	}
+
+	value, err := c.keyring.sealValue(c.id, value)
+	if err != nil {
+		log.Errorf("Failed to seal value of task (%s): %s", c.id, err)
+		return
+	}
+
+	if err := store.Emit(c.id, value); err != nil {
+		log.Errorf("Failed to emit value of task (%s): %s", c.id, err)
+	}
+}
+
+func (r *resultImpl) Progress() (*Progress, error) {
+	store, ok := r.store.(ProgressStore)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+
+	progress, err := store.GetProgress(r.id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.keyring.openProgress(r.id, progress); err != nil {
+		return nil, err
+	}
+
+	return progress, nil
+}
+
+func (r *resultImpl) Stream(ctx context.Context) <-chan interface{} {
+	ch := make(chan interface{})
+	store, ok := r.store.(ProgressStore)
+	peeker, peek := r.store.(ResultPeeker)
+	if !ok || !peek {
+		close(ch)
+		return ch
+	}
+
+	go func() {
+		defer close(ch)
+		offset := 0
+		for {
+			//the task is finished once its response is stored, the remaining values are sent before closing
+			_, err := peeker.Peek(r.id)
+			if err != nil && err != ErrNotFound {
+				log.Errorf("Failed to check if task (%s) is finished: %s", r.id, err)
+				return
+			}
+			finished := err == nil
+
+			values, err := store.Emitted(r.id, offset)
+			if err != nil {
+				log.Errorf("Failed to get emitted values of task (%s): %s", r.id, err)
+				return
+			}
+
+			for _, value := range values {
+				if value, err = r.keyring.openValue(r.id, value); err != nil {
+					log.Errorf("Failed to open emitted value of task (%s): %s", r.id, err)
+					return
+				}
+
+				select {
+				case ch <- value:
+				case <-ctx.Done():
+					return
+				}
+			}
+			offset += len(values)
+
+			if finished && len(values) == 0 {
+				return
+			} else if len(values) > 0 {
+				//there might be more values than a store returns at once
+				continue
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(streamPollInterval):
+			}
+		}
+	}()
+
+	return ch
+}
+
+//Progress of a group counts the finished tasks of the group (if the store implements ResultPeeker), Meta holds the
+//last progress of each task ([]*Progress, nil for the tasks that didn't report any)
+func (g *groupResultImpl) Progress() (*Progress, error) {
+	store, ok := g.store.(ProgressStore)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+
+	ids, err := g.get()
+	if err != nil {
+		return nil, err
+	}
+
+	peeker, peek := g.store.(ResultPeeker)
+	members := make([]*Progress, len(ids))
+	progress := &Progress{
+		Total: len(ids),
+		Meta:  members,
+		Time:  time.Now().UTC(),
+	}
+
+	for i, id := range ids {
+		if peek {
+			if _, err := peeker.Peek(id); err == nil {
+				progress.Current++
+			} else if err != ErrNotFound {
+				return nil, err
+			}
+		}
+
+		member, err := store.GetProgress(id)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		if err := g.keyring.openProgress(id, member); err != nil {
+			return nil, err
+		}
+
+		members[i] = member
+	}
+
+	return progress, nil
+}
+
+//Stream of a group receives the values emitted by all the tasks of the group as they come, the channel is closed
+//once all the tasks are finished
+func (g *groupResultImpl) Stream(ctx context.Context) <-chan interface{} {
+	ch := make(chan interface{})
+	go func() {
+		defer close(ch)
+		ids, err := g.get()
+		if err != nil {
+			log.Errorf("Failed to get the tasks of group (%s): %s", g.ID(), err)
+			return
+		}
+
+		var wg sync.WaitGroup
+		for _, id := range ids {
+			member := &resultImpl{
+				id:      id,
+				store:   g.store,
+				blobs:   g.blobs,
+				keyring: g.keyring,
+			}
+
+			wg.Add(1)
+			go func(values <-chan interface{}) {
+				defer wg.Done()
+				for value := range values {
+					select {
+					case ch <- value:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}(member.Stream(ctx))
+		}
+
+		wg.Wait()
+	}()
+
+	return ch
+}
@@ -0,0 +1,252 @@
+package wfe
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func testProgressStore(t *testing.T, store ResultStore, keyring *Keyring) {
+	c := &Context{
+		store:   store,
+		keyring: keyring,
+		id:      "1234",
+		values:  make(map[string]interface{}),
+	}
+
+	res := &resultImpl{
+		store:   store,
+		keyring: keyring,
+		id:      "1234",
+	}
+
+	_, err := res.Progress()
+	if ok := assert.Equal(t, ErrNotFound, err); !ok {
+		t.Fatal()
+	}
+
+	c.Progress(1, 10, "first")
+	c.Progress(2, 10, "second")
+
+	progress, err := res.Progress()
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, 2, progress.Current); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, "second", progress.Meta); !ok {
+		t.Fatal()
+	}
+
+	c.Emit("a")
+	c.Emit(2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream := res.Stream(ctx)
+	if ok := assert.Equal(t, "a", <-stream); !ok {
+		t.Fatal()
+	}
+
+	c.Emit("c")
+	if ok := assert.Nil(t, store.Set(&Response{UUID: "1234", State: StateSuccess})); !ok {
+		t.Fatal()
+	}
+
+	var values []interface{}
+	for value := range stream {
+		values = append(values, value)
+	}
+
+	if ok := assert.Equal(t, []interface{}{2, "c"}, values); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Nil(t, ctx.Err()); !ok {
+		t.Fatal()
+	}
+}
+
+func TestProgressBoltStore(t *testing.T) {
+	store, done := boltTestStore(t, "")
+	defer done()
+
+	testProgressStore(t, store, nil)
+}
+
+func TestProgressSQLStore(t *testing.T) {
+	store, done := sqliteTestStore(t, "")
+	defer done()
+
+	testProgressStore(t, store, nil)
+}
+
+func TestProgressSealed(t *testing.T) {
+	store, done := boltTestStore(t, "")
+	defer done()
+
+	keyring := securityTestKeyring()
+	testProgressStore(t, store, keyring)
+
+	//the progress and the values are not stored in the clear
+	progress, err := store.GetProgress("1234")
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Nil(t, progress.Meta); !ok {
+		t.Fatal()
+	}
+
+	values, err := store.Emitted("1234", 0)
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.IsType(t, &sealed{}, values[0]); !ok {
+		t.Fatal()
+	}
+
+	//the progress of a task can't be swapped in another task
+	if ok := assert.Nil(t, store.SetProgress("5678", progress)); !ok {
+		t.Fatal()
+	}
+
+	_, err = (&resultImpl{store: store, keyring: keyring, id: "5678"}).Progress()
+	if ok := assert.Equal(t, ErrInvalidSignature, err); !ok {
+		t.Fatal()
+	}
+
+	_, err = (&resultImpl{store: store, id: "1234"}).Progress()
+	if ok := assert.Equal(t, ErrNoKeyring, err); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Nil(t, store.SetProgress("1234", &Progress{Current: 1, Total: 1})); !ok {
+		t.Fatal()
+	}
+
+	_, err = (&resultImpl{store: store, keyring: keyring, id: "1234"}).Progress()
+	if ok := assert.Equal(t, ErrUnsigned, err); !ok {
+		t.Fatal()
+	}
+}
+
+func TestProgressNotSupported(t *testing.T) {
+	store := &testStore{}
+	c := &Context{
+		store: store,
+		id:    "1234",
+	}
+
+	//NOOP
+	c.Progress(1, 2, nil)
+	c.Emit(1)
+
+	res := &resultImpl{
+		store: store,
+		id:    "1234",
+	}
+
+	_, err := res.Progress()
+	if ok := assert.Equal(t, ErrNotSupported, err); !ok {
+		t.Fatal()
+	}
+
+	_, open := <-res.Stream(context.Background())
+	if ok := assert.False(t, open); !ok {
+		t.Fatal()
+	}
+}
+
+func TestProgressStreamNotPeeker(t *testing.T) {
+	bolt, done := boltTestStore(t, "")
+	defer done()
+
+	//the store can't tell when the task is finished
+	store := struct {
+		ResultStore
+		ProgressStore
+	}{bolt, bolt}
+
+	var res ProgressResult = &resultImpl{
+		store: store,
+		id:    "1234",
+	}
+
+	_, open := <-res.Stream(context.Background())
+	if ok := assert.False(t, open); !ok {
+		t.Fatal()
+	}
+}
+
+func TestGroupProgress(t *testing.T) {
+	store, done := boltTestStore(t, "")
+	defer done()
+
+	if ok := assert.Nil(t, store.Set(&Response{UUID: "group", State: StateSuccess, Result: []string{"m1", "m2"}})); !ok {
+		t.Fatal()
+	}
+
+	first := &Context{store: store, id: "m1", values: make(map[string]interface{})}
+	second := &Context{store: store, id: "m2", values: make(map[string]interface{})}
+
+	first.Progress(1, 2, "half")
+	first.Emit("a")
+	second.Emit("b")
+
+	var res ProgressResult = &groupResultImpl{
+		Result: &resultImpl{id: "group", store: store},
+		store:  store,
+	}
+
+	if ok := assert.Nil(t, store.Set(&Response{UUID: "m1", State: StateSuccess})); !ok {
+		t.Fatal()
+	}
+
+	progress, err := res.Progress()
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, []int{1, 2}, []int{progress.Current, progress.Total}); !ok {
+		t.Fatal()
+	}
+
+	members := progress.Meta.([]*Progress)
+	if ok := assert.Equal(t, "half", members[0].Meta); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Nil(t, members[1]); !ok {
+		t.Fatal()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream := res.Stream(ctx)
+	second.Emit("c")
+	if ok := assert.Nil(t, store.Set(&Response{UUID: "m2", State: StateSuccess})); !ok {
+		t.Fatal()
+	}
+
+	//the values of the tasks are interleaved, the stream ends once all the tasks are finished
+	var values []interface{}
+	for value := range stream {
+		values = append(values, value)
+	}
+
+	if ok := assert.ElementsMatch(t, []interface{}{"a", "b", "c"}, values); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Nil(t, ctx.Err()); !ok {
+		t.Fatal()
+	}
+}
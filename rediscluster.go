@@ -0,0 +1,324 @@
+package wfe
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	//redisClusterSlots number of hash slots of a redis cluster
+	redisClusterSlots = 16384
+	//redisClusterRedirects maximum number of MOVED or ASK redirections followed by a command
+	redisClusterRedirects = 5
+)
+
+//redisCluster routes each command to the node serving the slot of its key. The slots are loaded from the seed
+//nodes, and updated when a node answers with a MOVED redirection. Only single key commands can be routed, the
+//store runs its transactions one command at a time on a cluster.
+type redisCluster struct {
+	opts *RedisOptions
+
+	m     sync.RWMutex
+	slots []string
+	pools map[string]*redis.Pool
+}
+
+func newRedisCluster(opts *RedisOptions) *redisCluster {
+	return &redisCluster{
+		opts:  opts,
+		pools: make(map[string]*redis.Pool),
+	}
+}
+
+//redisSlot returns the hash slot of a key, only the hash tag (the part between braces) is hashed if there is one
+func redisSlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+
+	return int(crc16(key)) % redisClusterSlots
+}
+
+//crc16 is the CCITT (XMODEM) checksum used by redis to hash the keys
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+
+	return crc
+}
+
+//parseClusterSlots returns the address of the master serving each slot from a CLUSTER SLOTS reply
+func parseClusterSlots(reply interface{}) ([]string, error) {
+	ranges, err := redis.Values(reply, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	slots := make([]string, redisClusterSlots)
+	for _, r := range ranges {
+		fields, err := redis.Values(r, nil)
+		if err != nil || len(fields) < 3 {
+			return nil, fmt.Errorf("invalid cluster slots reply")
+		}
+
+		start, err := redis.Int(fields[0], nil)
+		if err != nil {
+			return nil, err
+		}
+
+		end, err := redis.Int(fields[1], nil)
+		if err != nil {
+			return nil, err
+		}
+
+		master, err := redis.Values(fields[2], nil)
+		if err != nil || len(master) < 2 {
+			return nil, fmt.Errorf("invalid cluster slots reply")
+		}
+
+		host, err := redis.String(master[0], nil)
+		if err != nil {
+			return nil, err
+		}
+
+		port, err := redis.Int(master[1], nil)
+		if err != nil {
+			return nil, err
+		}
+
+		for slot := start; slot <= end && slot < redisClusterSlots; slot++ {
+			slots[slot] = net.JoinHostPort(host, strconv.Itoa(port))
+		}
+	}
+
+	return slots, nil
+}
+
+//parseRedirect returns the kind (MOVED or ASK) and the target of a redirection error, an empty kind otherwise
+func parseRedirect(err error) (string, int, string) {
+	e, ok := err.(redis.Error)
+	if !ok {
+		return "", 0, ""
+	}
+
+	fields := strings.Fields(string(e))
+	if len(fields) != 3 || (fields[0] != "MOVED" && fields[0] != "ASK") {
+		return "", 0, ""
+	}
+
+	slot, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return "", 0, ""
+	}
+
+	return fields[0], slot, fields[2]
+}
+
+func (c *redisCluster) pool(addr string) *redis.Pool {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	pool, ok := c.pools[addr]
+	if !ok {
+		pool = c.opts.pool(func() (redis.Conn, error) {
+			return c.opts.dialAddr(addr)
+		})
+		c.pools[addr] = pool
+	}
+
+	return pool
+}
+
+//refresh loads the slots from the first node that answers, the seed nodes first
+func (c *redisCluster) refresh() error {
+	c.m.RLock()
+	addrs := append([]string{}, c.opts.Addrs...)
+	for addr := range c.pools {
+		addrs = append(addrs, addr)
+	}
+	c.m.RUnlock()
+
+	var err error
+	for _, addr := range addrs {
+		var reply interface{}
+		conn := c.pool(addr).Get()
+		reply, err = conn.Do("CLUSTER", "SLOTS")
+		conn.Close()
+		if err != nil {
+			continue
+		}
+
+		var slots []string
+		if slots, err = parseClusterSlots(reply); err != nil {
+			continue
+		}
+
+		c.m.Lock()
+		c.slots = slots
+		c.m.Unlock()
+		return nil
+	}
+
+	return fmt.Errorf("failed to load redis cluster slots: %s", err)
+}
+
+//addr returns the address of the node serving the key
+func (c *redisCluster) addr(key string) (string, error) {
+	slot := redisSlot(key)
+	lookup := func() string {
+		c.m.RLock()
+		defer c.m.RUnlock()
+
+		if c.slots == nil {
+			return ""
+		}
+
+		return c.slots[slot]
+	}
+
+	if addr := lookup(); addr != "" {
+		return addr, nil
+	}
+
+	if err := c.refresh(); err != nil {
+		return "", err
+	}
+
+	if addr := lookup(); addr != "" {
+		return addr, nil
+	}
+
+	return "", fmt.Errorf("redis cluster slot %d is not served", slot)
+}
+
+//moved records the node serving a slot after a MOVED redirection
+func (c *redisCluster) moved(slot int, addr string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.slots != nil && slot >= 0 && slot < redisClusterSlots {
+		c.slots[slot] = addr
+	}
+}
+
+//do runs a command on the node serving the key, following the MOVED and ASK redirections
+func (c *redisCluster) do(key string, name string, args ...interface{}) (interface{}, error) {
+	addr, err := c.addr(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.redirect(addr, false, name, args...)
+}
+
+func (c *redisCluster) redirect(addr string, asking bool, name string, args ...interface{}) (interface{}, error) {
+	for i := 0; ; i++ {
+		conn := c.pool(addr).Get()
+		if asking {
+			conn.Send("ASKING")
+		}
+
+		reply, err := conn.Do(name, args...)
+		conn.Close()
+
+		kind, slot, to := parseRedirect(err)
+		if kind == "" || i == redisClusterRedirects {
+			return reply, err
+		}
+
+		if kind == "MOVED" {
+			c.moved(slot, to)
+		}
+
+		addr, asking = to, kind == "ASK"
+	}
+}
+
+//doMany runs the same command for each key, pipelined on each node. A reply is nil if the key doesn't exist
+func (c *redisCluster) doMany(name string, keys []string, args ...interface{}) ([]interface{}, error) {
+	nodes := make(map[string][]int)
+	for i, key := range keys {
+		addr, err := c.addr(key)
+		if err != nil {
+			return nil, err
+		}
+
+		nodes[addr] = append(nodes[addr], i)
+	}
+
+	replies := make([]interface{}, len(keys))
+	for addr, indexes := range nodes {
+		if err := c.pipeline(addr, name, keys, indexes, replies, args...); err != nil {
+			return nil, err
+		}
+	}
+
+	return replies, nil
+}
+
+func (c *redisCluster) pipeline(addr string, name string, keys []string, indexes []int, replies []interface{}, args ...interface{}) error {
+	conn := c.pool(addr).Get()
+	defer conn.Close()
+
+	for _, i := range indexes {
+		conn.Send(name, append([]interface{}{keys[i]}, args...)...)
+	}
+
+	if err := conn.Flush(); err != nil {
+		return err
+	}
+
+	var redirected []int
+	for _, i := range indexes {
+		reply, err := conn.Receive()
+		if kind, _, _ := parseRedirect(err); kind != "" {
+			//the slot moved since the slots were loaded
+			redirected = append(redirected, i)
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		replies[i] = reply
+	}
+
+	for _, i := range redirected {
+		reply, err := c.do(keys[i], name, append([]interface{}{keys[i]}, args...)...)
+		if err != nil {
+			return err
+		}
+
+		replies[i] = reply
+	}
+
+	return nil
+}
+
+func (c *redisCluster) Close() error {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	var err error
+	for _, pool := range c.pools {
+		if e := pool.Close(); e != nil {
+			err = e
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,195 @@
+package wfe
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestClusterSlot(t *testing.T) {
+	if ok := assert.Equal(t, uint16(0x31C3), crc16("123456789")); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, 12182, redisSlot("foo")); !ok {
+		t.Fatal()
+	}
+
+	//only the hash tag is hashed
+	if ok := assert.Equal(t, redisSlot("{user1000}.following"), redisSlot("{user1000}.followers")); !ok {
+		t.Fatal()
+	}
+
+	//an empty hash tag is not a hash tag
+	if ok := assert.Equal(t, int(crc16("foo{}{bar}")%redisClusterSlots), redisSlot("foo{}{bar}")); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, redisSlot("{bar"), redisSlot("foo{{bar}}zap")); !ok {
+		t.Fatal()
+	}
+}
+
+func TestClusterSlotsReply(t *testing.T) {
+	slots, err := parseClusterSlots([]interface{}{
+		[]interface{}{int64(0), int64(5460), []interface{}{[]byte("10.0.0.1"), int64(7000), []byte("id1")}},
+		[]interface{}{int64(5461), int64(16383), []interface{}{[]byte("10.0.0.2"), int64(7001)}, []interface{}{[]byte("10.0.0.3"), int64(7002)}},
+	})
+
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, "10.0.0.1:7000", slots[5460]); !ok {
+		t.Fatal()
+	}
+
+	//replicas are not used
+	if ok := assert.Equal(t, "10.0.0.2:7001", slots[5461]); !ok {
+		t.Fatal()
+	}
+
+	kind, slot, addr := parseRedirect(redis.Error("MOVED 3999 127.0.0.1:6381"))
+	if ok := assert.Equal(t, []interface{}{"MOVED", 3999, "127.0.0.1:6381"}, []interface{}{kind, slot, addr}); !ok {
+		t.Fatal()
+	}
+
+	if kind, _, _ := parseRedirect(redis.Error("ERR unknown command")); kind != "" {
+		t.Fatal(kind)
+	}
+}
+
+//clusterTestNode is a fake cluster node, that answers the commands with the handler
+func clusterTestNode(t *testing.T, handler func(args []string) string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					args, err := clusterTestRead(r)
+					if err != nil {
+						return
+					}
+
+					if _, err := conn.Write([]byte(handler(args))); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+//clusterTestRead reads a command, an array of bulk strings
+func clusterTestRead(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]string, n)
+	for i := range args {
+		if _, err := r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+
+		arg, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+
+		args[i] = strings.TrimSpace(arg)
+	}
+
+	return args, nil
+}
+
+func TestClusterRedirect(t *testing.T) {
+	target := clusterTestNode(t, func(args []string) string {
+		switch {
+		case args[0] == "GET" && args[1] == "foo":
+			return "$3\r\nbar\r\n"
+		case args[0] == "GET":
+			return "$-1\r\n"
+		}
+
+		return "+PONG\r\n"
+	})
+
+	moved := clusterTestNode(t, func(args []string) string {
+		if args[0] == "PING" {
+			return "+PONG\r\n"
+		}
+
+		return fmt.Sprintf("-MOVED %d %s\r\n", redisSlot(args[1]), target)
+	})
+
+	host, port, _ := net.SplitHostPort(moved)
+	seed := clusterTestNode(t, func(args []string) string {
+		switch args[0] {
+		case "CLUSTER":
+			//all the slots are served by a node which moved them to the target since
+			return fmt.Sprintf("*1\r\n*3\r\n:0\r\n:16383\r\n*2\r\n$%d\r\n%s\r\n:%s\r\n", len(host), host, port)
+		case "PING":
+			return "+PONG\r\n"
+		}
+
+		return "-ERR unexpected\r\n"
+	})
+
+	cluster := newRedisCluster(&RedisOptions{Addrs: []string{seed}, MaxIdle: 1})
+	defer cluster.Close()
+
+	value, err := redis.String(cluster.do("foo", "GET", "foo"))
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, "bar", value); !ok {
+		t.Fatal()
+	}
+
+	//the moved slot is served by the target from now on
+	addr, err := cluster.addr("foo")
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, target, addr); !ok {
+		t.Fatal()
+	}
+
+	replies, err := cluster.doMany("GET", []string{"foo", "baz"})
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, []interface{}{[]byte("bar"), nil}, replies); !ok {
+		t.Fatal()
+	}
+}
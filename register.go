@@ -4,17 +4,137 @@ import (
 	"fmt"
 	"reflect"
 	"runtime"
+	"sort"
 	"sync"
+	"time"
 )
 
 var (
-	fns = make(map[string]function)
-	m   sync.Mutex
+	fns   = make(map[string]function)
+	names = make(map[uintptr]symbol)
+	m     sync.Mutex
+
+	errorType = reflect.TypeOf((*error)(nil)).Elem()
 )
 
 type function struct {
-	queue string
-	fn    interface{}
+	name       string
+	queue      string
+	exchange   string
+	kind       string
+	routingKey string
+	priority   int
+	ttl        time.Duration
+	job        *JobOptions
+	version    string
+	aliases    []string
+	idempotent bool
+	window     time.Duration
+	fn         interface{}
+}
+
+//symbol is the name a task function code pointer is registered with
+type symbol struct {
+	name     string
+	explicit bool
+}
+
+//TaskInfo describes a registered task function
+type TaskInfo struct {
+	//Name the task is registered with
+	Name string `json:"name"`
+	//Aliases of the task name
+	Aliases []string `json:"aliases,omitempty"`
+	//Queue the task is routed to, empty for the default queue
+	Queue string `json:"queue,omitempty"`
+	//Exchange the task is published to, if it's routed by an exchange
+	Exchange string `json:"exchange,omitempty"`
+	//RoutingKey the task is published with, if it's routed by an exchange
+	RoutingKey string `json:"routing_key,omitempty"`
+	//Priority the task requests are dispatched with by default
+	Priority int `json:"priority,omitempty"`
+	//Version of the task, empty if the task is not versioned
+	Version string `json:"version,omitempty"`
+	//Params type names of the task arguments (the *Context argument excluded). A variadic argument is prefixed by `...`
+	Params []string `json:"params"`
+	//Returns type name of the task result, empty if the task doesn't return an object
+	Returns string `json:"returns,omitempty"`
+
+	typ reflect.Type
+}
+
+//RegisterOption configures a task function registered with RegisterNamed
+type RegisterOption func(f *function)
+
+//OnQueue routes the task to the given queue instead of the default queue
+func OnQueue(queue string) RegisterOption {
+	return func(f *function) {
+		f.queue = queue
+	}
+}
+
+/*
+OnExchange routes the task through an exchange (of type `direct`, `fanout` or `topic`) with the given routing key,
+instead of sending it to a queue. The workers bind their queues to the exchange (see Queue), so a task can be
+fanned out to many worker pools, or routed by topic. The routing key can be changed per call with RoutingKey.
+
+	wfe.RegisterNamed("reports.build", Build, wfe.OnExchange("wfe.reports", "topic", "tenant.default"))
+
+Exchanges are only supported by the amqp broker.
+*/
+func OnExchange(exchange, kind, routingKey string) RegisterOption {
+	return func(f *function) {
+		f.exchange = exchange
+		f.kind = kind
+		f.routingKey = routingKey
+	}
+}
+
+/*
+RoutingKey overrides the routing key of a task routed by OnExchange for a single call, for example to route the
+request to the workers of a tenant.
+
+	req := wfe.With(wfe.MustCall(Build, report), wfe.RoutingKey("tenant."+report.Tenant))
+*/
+func RoutingKey(key string) CallOption {
+	return func(r *requestImpl) {
+		r.RoutingKey = key
+	}
+}
+
+/*
+Job sets the delivery options of the task requests, for the brokers that support them (disque). They override the
+options of the queue.
+
+	wfe.RegisterNamed("mail.send", Send, wfe.Job(wfe.JobOptions{Retry: 5 * time.Minute, Replicate: 2}))
+*/
+func Job(o JobOptions) RegisterOption {
+	return func(f *function) {
+		f.job = &o
+	}
+}
+
+/*
+Version sets the version of the task. Requests created by Call carry the version of the task, and a worker only runs
+requests of the version it implements (or unversioned requests). Bump the version when the task signature changes
+so workers of an older (or newer) release don't call it with mismatching arguments.
+
+	wfe.RegisterNamed("billing.charge", Charge, wfe.Version("2"))
+*/
+func Version(version string) RegisterOption {
+	return func(f *function) {
+		f.version = version
+	}
+}
+
+//Alias registers extra names for the task. Requests addressed to an alias are executed by the task, which is useful
+//to keep in flight messages working after a task is renamed, or moved to another package
+//
+//	wfe.RegisterNamed("billing.charge", Charge, wfe.Alias("github.com/acme/billing.Charge"))
+func Alias(names ...string) RegisterOption {
+	return func(f *function) {
+		f.aliases = append(f.aliases, names...)
+	}
 }
 
 func validateWorkFunc(v reflect.Value) error {
@@ -30,8 +150,12 @@ func validateWorkFunc(v reflect.Value) error {
 		return fmt.Errorf("worker function first argument not of type *wfe.Context")
 	}
 
-	if t.NumOut() > 1 {
-		return fmt.Errorf("worker function must return maximum of one object")
+	if t.NumOut() > 2 {
+		return fmt.Errorf("worker function must return maximum of one object and an error")
+	}
+
+	if t.NumOut() == 2 && t.Out(1) != errorType {
+		return fmt.Errorf("worker function second return value not of type error")
 	}
 
 	return nil
@@ -39,8 +163,15 @@ func validateWorkFunc(v reflect.Value) error {
 
 /*
 Register a task function. A task function must accept a `*Context` as first argument followed by and any number of arguments
-needed by the task. A task function can return zero or one object.
-Register panics if the task signature is wrongThe register process usually happens inside an init function
+needed by the task. A task function can return zero or one object, optionally followed by an error. So all of the
+following are valid task signatures
+
+	func(c *wfe.Context, args...)
+	func(c *wfe.Context, args...) T
+	func(c *wfe.Context, args...) error
+	func(c *wfe.Context, args...) (T, error)
+
+Register panics if the task signature is wrong. The register process usually happens inside an init function
 
 Example:
 	func Add(c *gin.Context, args ...int) {
@@ -55,7 +186,15 @@ Example:
 		wfe.Register(Add)
 	}
 
-Note: A task can return an error by a panic
+Note: A task can fail by returning a non nil error as its last return value, or by a panic. A returned error is
+recorded as is, without a stack trace.
+
+	func Div(c *wfe.Context, a, b int) (int, error) {
+		if b == 0 {
+			return 0, errors.New("division by zero")
+		}
+		return a / b, nil
+	}
 */
 func Register(fn interface{}, queue ...string) {
 	v := reflect.ValueOf(fn)
@@ -63,31 +202,226 @@ func Register(fn interface{}, queue ...string) {
 		panic("only one queue is allowed per function")
 	}
 
-	q := ""
+	if err := validateWorkFunc(v); err != nil {
+		panic(err)
+	}
+
+	var opts []RegisterOption
 	if len(queue) == 1 {
-		q = queue[0]
+		opts = append(opts, OnQueue(queue[0]))
 	}
 
-	if err := validateWorkFunc(v); err != nil {
+	register(runtime.FuncForPC(v.Pointer()).Name(), false, fn, opts...)
+}
+
+/*
+RegisterNamed registers a task function under an explicit name. Requests created by Call for this function use the
+given name instead of the function symbol name, so renaming the function or moving it to another package doesn't
+break messages that are already queued or clients built from an older binary.
+
+	func init() {
+		wfe.RegisterNamed("math.add", Add, wfe.OnQueue("math"), wfe.Alias("github.com/acme/functions.Add"))
+	}
+
+RegisterNamed panics if the task signature is wrong, if the name (or one of the aliases) is already registered
+for another function, or if the function is already registered under another explicit name. Use Alias to give a task
+more than one name. Note that the closures created by the same function literal share their code, so they are the
+same task function: only one of them can be registered, and Call resolves all of them to the same name.
+*/
+func RegisterNamed(name string, fn interface{}, opts ...RegisterOption) {
+	if name == "" {
+		panic("function name is empty")
+	}
+
+	if err := validateWorkFunc(reflect.ValueOf(fn)); err != nil {
 		panic(err)
 	}
 
-	n := runtime.FuncForPC(v.Pointer()).Name()
-	log.Debugf("Registering function '%s'", n)
+	register(name, true, fn, opts...)
+}
+
+func register(name string, explicit bool, fn interface{}, opts ...RegisterOption) {
+	f := function{
+		name: name,
+		fn:   fn,
+	}
+
+	for _, opt := range opts {
+		opt(&f)
+	}
+
+	ptr := reflect.ValueOf(fn).Pointer()
+	all := append([]string{name}, f.aliases...)
+
 	m.Lock()
 	defer m.Unlock()
-	fns[n] = function{
-		queue: q,
-		fn:    fn,
+
+	for _, n := range all {
+		if e, ok := fns[n]; ok && reflect.ValueOf(e.fn).Pointer() != ptr {
+			panic(fmt.Errorf("function name '%s' is already registered", n))
+		}
+	}
+
+	if s, ok := names[ptr]; ok && explicit && s.explicit && s.name != name {
+		panic(fmt.Errorf("function '%s' is already registered as '%s'", name, s.name))
+	}
+
+	log.Debugf("Registering function '%s'", name)
+	for _, n := range all {
+		fns[n] = f
+	}
+
+	//an explicit name always wins over the function symbol name
+	if _, ok := names[ptr]; explicit || !ok {
+		names[ptr] = symbol{name: name, explicit: explicit}
 	}
 }
 
+//route returns the route options the task requests are dispatched with
+func (f *function) route() *RouteOptions {
+	var o *RouteOptions
+	switch {
+	case f.exchange != "":
+		o = &RouteOptions{
+			Exchange:     f.exchange,
+			ExchangeType: f.kind,
+			RoutingKey:   f.routingKey,
+			Durable:      true,
+		}
+	case f.queue != "":
+		o = &RouteOptions{
+			Queue:   f.queue,
+			Durable: true,
+		}
+	case f.job != nil:
+		route := *WorkQueueRoute
+		o = &route
+	default:
+		return WorkQueueRoute
+	}
+
+	o.Job = f.job
+	return o
+}
+
+func (f *function) info() TaskInfo {
+	t := reflect.TypeOf(f.fn)
+	info := TaskInfo{
+		Name:       f.name,
+		Aliases:    f.aliases,
+		Queue:      f.queue,
+		Exchange:   f.exchange,
+		RoutingKey: f.routingKey,
+		Priority:   f.priority,
+		Version:    f.version,
+		Params:     []string{},
+		typ:        t,
+	}
+
+	for i := 1; i < t.NumIn(); i++ {
+		if t.IsVariadic() && i == t.NumIn()-1 {
+			info.Params = append(info.Params, "..."+t.In(i).Elem().String())
+		} else {
+			info.Params = append(info.Params, t.In(i).String())
+		}
+	}
+
+	if t.NumOut() > 0 && t.Out(0) != errorType {
+		info.Returns = t.Out(0).String()
+	}
+
+	return info
+}
+
+//Registry lists all the registered task functions sorted by name. A function registered by both Register and
+//RegisterNamed is listed once under its explicit name, with the symbol name as an alias.
+func Registry() []TaskInfo {
+	m.Lock()
+	defer m.Unlock()
+
+	infos := make(map[string]*TaskInfo)
+	symbols := make(map[string][]string)
+	for n, f := range fns {
+		if n != f.name {
+			//alias entry
+			continue
+		}
+
+		if s := names[reflect.ValueOf(f.fn).Pointer()]; s.name != f.name {
+			//registered by symbol name, and under an explicit name
+			symbols[s.name] = append(symbols[s.name], f.name)
+			continue
+		}
+
+		info := f.info()
+		infos[n] = &info
+	}
+
+	var registry []TaskInfo
+	for n, info := range infos {
+		if aliases, ok := symbols[n]; ok {
+			info.Aliases = append(append([]string{}, info.Aliases...), aliases...)
+		}
+		registry = append(registry, *info)
+	}
+
+	sort.Slice(registry, func(i, j int) bool {
+		return registry[i].Name < registry[j].Name
+	})
+
+	return registry
+}
+
+//nameOf returns the name a task function is registered with, or the function symbol name if it's not registered
+func nameOf(fn reflect.Value) string {
+	m.Lock()
+	defer m.Unlock()
+
+	if s, ok := names[fn.Pointer()]; ok {
+		return s.name
+	}
+
+	return runtime.FuncForPC(fn.Pointer()).Name()
+}
+
+//versionOf returns the version a task function is registered with
+func versionOf(fn reflect.Value) string {
+	m.Lock()
+	defer m.Unlock()
+
+	if s, ok := names[fn.Pointer()]; ok {
+		return fns[s.name].version
+	}
+
+	return ""
+}
+
+//keyOf returns the derived idempotency key of a call if the task function is registered as Idempotent
+func keyOf(fn reflect.Value, args interface{}) (string, error) {
+	m.Lock()
+	s, ok := names[fn.Pointer()]
+	idempotent := ok && fns[s.name].idempotent
+	m.Unlock()
+
+	if idempotent {
+		return deriveKey(s.name, args)
+	}
+
+	return "", nil
+}
+
 func registered(fn string) (function, bool) {
+	m.Lock()
+	defer m.Unlock()
+
 	f, ok := fns[fn]
 	return f, ok
 }
 
 func Registered(fn string) (interface{}, bool) {
+	m.Lock()
+	defer m.Unlock()
+
 	f, ok := fns[fn]
 	return f.fn, ok
 }
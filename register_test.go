@@ -3,7 +3,9 @@ package wfe
 import (
 	"github.com/stretchr/testify/assert"
 	"reflect"
+	"runtime"
 	"testing"
+	"time"
 )
 
 func TestValidateTaskFnOk(t *testing.T) {
@@ -23,7 +25,15 @@ func TestValidateTaskFnOk(t *testing.T) {
 
 	}
 
-	for _, fn := range []interface{}{a, b, c, d} {
+	e := func(c *Context, a int) (int, error) {
+		return a, nil
+	}
+
+	f := func(c *Context, a int) error {
+		return nil
+	}
+
+	for _, fn := range []interface{}{a, b, c, d, e, f} {
 		v := reflect.ValueOf(fn)
 
 		err := validateWorkFunc(v)
@@ -42,7 +52,11 @@ func TestValidateTaskFnError(t *testing.T) {
 		return a, a
 	}
 
-	for _, fn := range []interface{}{a, c} {
+	d := func(c *Context, a int) (int, error, error) {
+		return a, nil, nil
+	}
+
+	for _, fn := range []interface{}{a, c, d} {
 		v := reflect.ValueOf(fn)
 
 		err := validateWorkFunc(v)
@@ -99,3 +113,161 @@ func TestRegisterPanic(t *testing.T) {
 		Register(fn)
 	}
 }
+
+func registerNamedTest(c *Context, a int) int {
+	return a
+}
+
+func TestRegisterNamed(t *testing.T) {
+	RegisterNamed("wfe.test.named", registerNamedTest, OnQueue("named"), Alias("wfe.test.old-name"))
+
+	req := MustCall(registerNamedTest, 1)
+	if ok := assert.Equal(t, "wfe.test.named", req.Fn()); !ok {
+		t.Fatal()
+	}
+
+	for _, name := range []string{"wfe.test.named", "wfe.test.old-name"} {
+		f, ok := registered(name)
+		if ok := assert.True(t, ok); !ok {
+			t.Fatal()
+		}
+
+		if ok := assert.Equal(t, "wfe.test.named", f.name); !ok {
+			t.Fatal()
+		}
+
+		if ok := assert.Equal(t, "named", f.queue); !ok {
+			t.Fatal()
+		}
+	}
+
+	//registering by symbol name doesn't override the explicit name
+	Register(registerNamedTest)
+	if ok := assert.Equal(t, "wfe.test.named", MustCall(registerNamedTest, 1).Fn()); !ok {
+		t.Fatal()
+	}
+}
+
+func TestRegisterNamedConflict(t *testing.T) {
+	a := func(c *Context) {
+
+	}
+
+	b := func(c *Context) {
+
+	}
+
+	RegisterNamed("wfe.test.conflict", a)
+
+	defer func() {
+		err := recover()
+		if ok := assert.NotNil(t, err); !ok {
+			t.Fatal()
+		}
+	}()
+
+	RegisterNamed("wfe.test.other", b, Alias("wfe.test.conflict"))
+}
+
+func TestRegisterNamedClosures(t *testing.T) {
+	closure := func(n int) func(c *Context) int {
+		return func(c *Context) int {
+			return n
+		}
+	}
+
+	RegisterNamed("wfe.test.closure.1", closure(1))
+
+	defer func() {
+		err := recover()
+		if ok := assert.NotNil(t, err); !ok {
+			t.Fatal()
+		}
+	}()
+
+	//closures of the same literal share the same code, so they can't be told apart
+	RegisterNamed("wfe.test.closure.2", closure(2))
+}
+
+func registryTest(c *Context, a int, b []string, opts ...float64) (string, error) {
+	return "", nil
+}
+
+func TestRegistry(t *testing.T) {
+	RegisterNamed("wfe.test.registry", registryTest, OnQueue("registry"), Alias("wfe.test.registry.v0"))
+	Register(registryTest)
+
+	symbol := runtime.FuncForPC(reflect.ValueOf(registryTest).Pointer()).Name()
+
+	var info *TaskInfo
+	registry := Registry()
+	for i := range registry {
+		if ok := assert.NotContains(t, []string{"wfe.test.registry.v0", symbol}, registry[i].Name); !ok {
+			t.Fatal()
+		}
+		if registry[i].Name == "wfe.test.registry" {
+			info = &registry[i]
+		}
+	}
+
+	if ok := assert.NotNil(t, info); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, []string{"int", "[]string", "...float64"}, info.Params); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, "string", info.Returns); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, "registry", info.Queue); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, []string{"wfe.test.registry.v0", symbol}, info.Aliases); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Nil(t, (&TaskInfo{Name: "wfe.test.registry"}).JSONSchema()); !ok {
+		t.Fatal()
+	}
+
+	schema := info.JSONSchema()
+	if ok := assert.Equal(t, []interface{}{
+		map[string]interface{}{"type": "integer"},
+		map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+	}, schema["items"]); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, map[string]interface{}{"type": "number"}, schema["additionalItems"]); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, 2, schema["minItems"]); !ok {
+		t.Fatal()
+	}
+}
+
+func registerJobTest(c *Context) {}
+
+func TestRegisterJob(t *testing.T) {
+	RegisterNamed("register.job", registerJobTest, Job(JobOptions{Retry: time.Minute}))
+
+	f, _ := registered("register.job")
+	route := f.route()
+	if ok := assert.Equal(t, DefaultQueueName, route.Queue); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, &JobOptions{Retry: time.Minute}, route.Job); !ok {
+		t.Fatal()
+	}
+
+	//the default route is not changed
+	if ok := assert.Nil(t, WorkQueueRoute.Job); !ok {
+		t.Fatal()
+	}
+}
@@ -2,7 +2,6 @@ package wfe
 
 import (
 	"encoding/gob"
-	"errors"
 	"sync"
 )
 
@@ -15,7 +14,8 @@ type Result interface {
 	//ID of the result (matches the Request ID)
 	ID() string
 
-	//Get waits for the task to finish and return the returned object and an error if the task failed
+	//Get waits for the task to finish and return the returned object and an error if the task failed.
+	//If the task failed the error is a *TaskError
 	Get() (interface{}, error)
 
 	//MustGet same as Get but panics on error.
@@ -23,11 +23,13 @@ type Result interface {
 }
 
 type resultImpl struct {
-	id    string
-	store ResultStore
-	o     sync.Once
-	value interface{}
-	err   error
+	id      string
+	store   ResultStore
+	blobs   *offloader
+	keyring *Keyring
+	o       sync.Once
+	value   interface{}
+	err     error
 }
 
 func (r *resultImpl) ID() string {
@@ -59,8 +61,16 @@ func (r *resultImpl) get() (interface{}, error) {
 		return nil, err
 	}
 
-	if response.State == StateError {
-		return nil, errors.New(response.Error)
+	if err := r.keyring.openResponse(response); err != nil {
+		return nil, err
+	}
+
+	if err := response.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := r.blobs.loadResponse(response); err != nil {
+		return nil, err
 	}
 
 	return response.Result, nil
@@ -66,3 +66,37 @@ func TestResultGetTaskError(t *testing.T) {
 	}
 
 }
+
+func TestResultGetTaskErrorAs(t *testing.T) {
+	store := &testStore{}
+
+	store.On("Get", "1234", DefaultTimeout).Return(&Response{
+		UUID:      "1234",
+		State:     StateError,
+		Error:     "invalid",
+		ErrorType: "*errors.errorString",
+		ErrorCode: "E1",
+		Retryable: true,
+	}, nil)
+
+	res := resultImpl{
+		store: store,
+		id:    "1234",
+	}
+
+	_, e := res.Get()
+
+	var te *TaskError
+	if ok := assert.True(t, errors.As(e, &te)); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, &TaskError{
+		Type:      "*errors.errorString",
+		Code:      "E1",
+		Message:   "invalid",
+		Retryable: true,
+	}, te); !ok {
+		t.Fatal()
+	}
+}
@@ -0,0 +1,146 @@
+package wfe
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+const (
+	jsonSchemaDraft = "http://json-schema.org/draft-07/schema#"
+)
+
+/*
+JSONSchema returns a JSON schema (draft 07) of the task arguments. Task arguments are described as a JSON array where
+each item matches the task parameter at the same position, so non go producers can validate a call before enqueuing it.
+
+	{"$schema": "...", "title": "math.add", "type": "array",
+	 "items": [{"type": "integer"}, {"type": "integer"}], "minItems": 2, "additionalItems": false}
+
+JSONSchema returns nil if the task info is not listed by Registry (for example if it's decoded from a worker
+advertised registry), since the task parameter types are not known.
+*/
+func (t *TaskInfo) JSONSchema() map[string]interface{} {
+	if t.typ == nil {
+		return nil
+	}
+
+	var items []interface{}
+	var additional interface{} = false
+
+	required := 0
+	for i := 1; i < t.typ.NumIn(); i++ {
+		in := t.typ.In(i)
+		if t.typ.IsVariadic() && i == t.typ.NumIn()-1 {
+			additional = typeSchema(in.Elem(), nil)
+			continue
+		}
+
+		items = append(items, typeSchema(in, nil))
+		required++
+	}
+
+	schema := map[string]interface{}{
+		"$schema":         jsonSchemaDraft,
+		"title":           t.Name,
+		"type":            "array",
+		"minItems":        required,
+		"additionalItems": additional,
+	}
+
+	if len(items) > 0 {
+		schema["items"] = items
+	}
+
+	return schema
+}
+
+//RegistryJSONSchema exports the JSON schema of the arguments of all the registered tasks, keyed by the task name.
+func RegistryJSONSchema() ([]byte, error) {
+	schemas := make(map[string]interface{})
+	for _, info := range Registry() {
+		schemas[info.Name] = info.JSONSchema()
+	}
+
+	return json.MarshalIndent(schemas, "", "  ")
+}
+
+//typeSchema maps a go type to a json schema, seen holds the struct types on the current path to break recursion
+func typeSchema(t reflect.Type, seen []reflect.Type) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Ptr:
+		return typeSchema(t.Elem(), seen)
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "contentEncoding": "base64"}
+		}
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem(), seen)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Elem(), seen)}
+	case reflect.Struct:
+		for _, s := range seen {
+			if s == t {
+				return map[string]interface{}{"type": "object"}
+			}
+		}
+		return structSchema(t, append(seen, t))
+	}
+
+	//interfaces, channels, functions. anything goes
+	return map[string]interface{}{}
+}
+
+func structSchema(t reflect.Type, seen []reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	var required []string
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			//unexported
+			continue
+		}
+
+		name := field.Name
+		optional := field.Type.Kind() == reflect.Ptr
+		if tag := field.Tag.Get("json"); tag != "" {
+			parts := strings.Split(tag, ",")
+			if parts[0] == "-" {
+				continue
+			}
+			if parts[0] != "" {
+				name = parts[0]
+			}
+			for _, opt := range parts[1:] {
+				if opt == "omitempty" {
+					optional = true
+				}
+			}
+		}
+
+		properties[name] = typeSchema(field.Type, seen)
+		if !optional {
+			required = append(required, name)
+		}
+	}
+
+	schema := map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+	}
+
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+
+	return schema
+}
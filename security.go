@@ -0,0 +1,492 @@
+package wfe
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	//DefaultReplayWindow how long a sealed request can be run after it's sealed, if the keyring doesn't set a window
+	DefaultReplayWindow = 24 * time.Hour
+
+	sealHMAC    = "hmac-sha256"
+	sealEd25519 = "ed25519"
+
+	sealTokenSize  = 16
+	sealReplayTmpl = "seal.%s"
+)
+
+var (
+	//ErrUnsigned a message or result is not signed while a keyring is configured
+	ErrUnsigned = errors.New("message is not signed")
+
+	//ErrInvalidSignature a message or result signature doesn't match its content
+	ErrInvalidSignature = errors.New("invalid message signature")
+
+	//ErrUnknownKey a message or result is sealed with a key that is not in the keyring
+	ErrUnknownKey = errors.New("unknown key id")
+
+	//ErrNoKeyring a message or result is sealed but no keyring is configured to open it
+	ErrNoKeyring = errors.New("message is sealed but no keyring is configured")
+
+	//ErrReplayed a sealed request is older than the replay window, was published under another id, or already ran
+	ErrReplayed = errors.New("message is replayed")
+
+	//ErrReplayPending a sealed request is being run by another worker
+	ErrReplayPending = errors.New("message is being run by another worker")
+)
+
+/*
+SecurityKey is a key of the Keyring. A key signs with Ed25519 if it has a PrivateKey (to sign) or PublicKey
+(to verify), with HMAC-SHA256 of the Secret otherwise. If Cipher is set the payloads are also encrypted with AES-GCM.
+*/
+type SecurityKey struct {
+	//Secret shared HMAC-SHA256 secret
+	Secret []byte
+	//PrivateKey Ed25519 key of the signing side
+	PrivateKey ed25519.PrivateKey
+	//PublicKey Ed25519 key of the verifying side
+	PublicKey ed25519.PublicKey
+	//Cipher AES key (16, 24 or 32 bytes), the payloads are encrypted if set
+	Cipher []byte
+}
+
+/*
+Keyring signs (and optionally encrypts) the requests sent by the clients and the results stored by the workers, with
+their offloaded blobs. When a keyring is set, workers reject the requests that are not signed by one of its keys before
+running them, and clients reject the results that are not signed. The progress and the values emitted by the tasks are
+sealed like the results.
+
+Keys are rotated by adding the new key to the keyring of all the clients and workers, then switching KeyID to the
+new key. The old key can be removed once the messages sealed with it are consumed and their results expired.
+
+The results are sealed with ResultKeyID (or KeyID if it's not set). With Ed25519 keys, the clients sign the requests
+with the private key of KeyID and the workers sign the results with the private key of ResultKeyID, so each side only
+holds the public key of the other. Workers that apply tasks themselves (chains and chords) need the KeyID private key.
+
+A sealed request is only run within the ReplayWindow after it's sealed. If the dispatcher lets the client choose the
+message id (amqp), the id is sealed with the request, so the request can't be published again under another id. If the
+result store implements IdempotencyStore, the workers also claim the random token of each sealed request while they
+run it, and remember it for the window once it ran: a copy of the request published again is not run, and doesn't
+overwrite the result. A message redelivered after its worker died is run once the claim of the dead worker expires.
+
+	o := &wfe.Options{
+		Broker: "amqp://localhost:5672",
+		Keyring: &wfe.Keyring{
+			KeyID: "2024-01",
+			Keys: map[string]*wfe.SecurityKey{
+				"2024-01": {Secret: secret, Cipher: aesKey},
+			},
+		},
+	}
+*/
+type Keyring struct {
+	//KeyID of the key used to seal new requests, and the results if ResultKeyID is not set
+	KeyID string
+	//ResultKeyID of the key used by the workers to seal the results
+	ResultKeyID string
+	//ReplayWindow how long a sealed request can be run after it's sealed, DefaultReplayWindow if not set
+	ReplayWindow time.Duration
+	//Compress the sealed payloads with gzip, zstd or snappy before they're encrypted, as the compression of the brokers
+	//and the stores only sees the encrypted payloads. The payloads smaller than DefaultCompressMin are not compressed
+	Compress string
+	//Keys by id, all the keys can open a sealed message
+	Keys map[string]*SecurityKey
+}
+
+func init() {
+	//emitted values are sealed as a whole
+	gob.Register(&sealed{})
+}
+
+//sealed is a signed (and optionally encrypted) gob encoded payload
+type sealed struct {
+	KeyID string
+	Alg   string
+	//Token random id of the sealed payload, Issued the time it's sealed (unix nanoseconds)
+	Token  []byte
+	Issued int64
+	//ID of the message the payload is dispatched as, empty if the broker picks the ids
+	ID        string
+	Nonce     []byte
+	Payload   []byte
+	Signature []byte
+}
+
+//signed returns the signed content, each field is length prefixed so the fields can't be shifted
+func (s *sealed) signed() []byte {
+	var buffer bytes.Buffer
+	issued := make([]byte, 8)
+	binary.BigEndian.PutUint64(issued, uint64(s.Issued))
+	for _, field := range [][]byte{[]byte(s.KeyID), []byte(s.Alg), s.Token, issued, []byte(s.ID), s.Nonce, s.Payload} {
+		binary.Write(&buffer, binary.BigEndian, uint32(len(field)))
+		buffer.Write(field)
+	}
+
+	return buffer.Bytes()
+}
+
+func (k *SecurityKey) aead() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(k.Cipher)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func (k *Keyring) resultKeyID() string {
+	if k.ResultKeyID != "" {
+		return k.ResultKeyID
+	}
+
+	return k.KeyID
+}
+
+func (k *Keyring) replayWindow() time.Duration {
+	if k.ReplayWindow > 0 {
+		return k.ReplayWindow
+	}
+
+	return DefaultReplayWindow
+}
+
+func (k *Keyring) seal(id string, message string, v interface{}) (*sealed, error) {
+	key, ok := k.Keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w '%s'", ErrUnknownKey, id)
+	}
+
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(v); err != nil {
+		return nil, err
+	}
+
+	compression, err := newCompression(k.Compress, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := compression.compress(buffer.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	s := &sealed{
+		KeyID:   id,
+		Token:   make([]byte, sealTokenSize),
+		Issued:  time.Now().UnixNano(),
+		ID:      message,
+		Payload: payload,
+	}
+
+	if _, err := rand.Read(s.Token); err != nil {
+		return nil, err
+	}
+
+	if len(key.Cipher) > 0 {
+		aead, err := key.aead()
+		if err != nil {
+			return nil, err
+		}
+
+		s.Nonce = make([]byte, aead.NonceSize())
+		if _, err := rand.Read(s.Nonce); err != nil {
+			return nil, err
+		}
+
+		s.Payload = aead.Seal(nil, s.Nonce, s.Payload, []byte(s.KeyID))
+	}
+
+	switch {
+	case len(key.PrivateKey) > 0:
+		s.Alg = sealEd25519
+		s.Signature = ed25519.Sign(key.PrivateKey, s.signed())
+	case len(key.Secret) > 0:
+		s.Alg = sealHMAC
+		mac := hmac.New(sha256.New, key.Secret)
+		mac.Write(s.signed())
+		s.Signature = mac.Sum(nil)
+	default:
+		return nil, fmt.Errorf("key '%s' can't sign", id)
+	}
+
+	return s, nil
+}
+
+func (k *Keyring) open(s *sealed, v interface{}) error {
+	key, ok := k.Keys[s.KeyID]
+	if !ok {
+		return fmt.Errorf("%w '%s'", ErrUnknownKey, s.KeyID)
+	}
+
+	//the algorithm is decided by the key, not by the message
+	switch {
+	case len(key.PublicKey) > 0 || len(key.PrivateKey) > 0:
+		public := key.PublicKey
+		if len(public) == 0 {
+			public = key.PrivateKey.Public().(ed25519.PublicKey)
+		}
+		if s.Alg != sealEd25519 || !ed25519.Verify(public, s.signed(), s.Signature) {
+			return ErrInvalidSignature
+		}
+	case len(key.Secret) > 0:
+		mac := hmac.New(sha256.New, key.Secret)
+		mac.Write(s.signed())
+		if s.Alg != sealHMAC || !hmac.Equal(mac.Sum(nil), s.Signature) {
+			return ErrInvalidSignature
+		}
+	default:
+		return fmt.Errorf("key '%s' can't verify", s.KeyID)
+	}
+
+	payload := s.Payload
+	if len(key.Cipher) > 0 {
+		aead, err := key.aead()
+		if err != nil {
+			return err
+		}
+
+		if payload, err = aead.Open(nil, s.Nonce, payload, []byte(s.KeyID)); err != nil {
+			return ErrInvalidSignature
+		}
+	} else if len(s.Nonce) > 0 {
+		return fmt.Errorf("key '%s' can't decrypt", s.KeyID)
+	}
+
+	//the payloads are compressed before they're encrypted
+	payload, err := decompress(payload)
+	if err != nil {
+		return err
+	}
+
+	return gob.NewDecoder(bytes.NewReader(payload)).Decode(v)
+}
+
+//sealRequest returns an envelope request that only carries the sealed request, a nil keyring doesn't seal. The id is
+//the id of the message the request is dispatched as, empty if the dispatcher picks it
+func (k *Keyring) sealRequest(req Request, id string) (Request, error) {
+	r, ok := req.(*requestImpl)
+	if k == nil || !ok {
+		return req, nil
+	}
+
+	s, err := k.seal(k.KeyID, id, r)
+	if err != nil {
+		return nil, err
+	}
+
+	return &requestImpl{Seal: s}, nil
+}
+
+//openRequest verifies the request and replaces the envelope with the sealed request, it returns the seal of the
+//request (nil if no keyring is used)
+func (k *Keyring) openRequest(r *requestImpl) (*sealed, error) {
+	if r.Seal == nil {
+		if k != nil {
+			return nil, ErrUnsigned
+		}
+		return nil, nil
+	}
+
+	if k == nil {
+		return nil, ErrNoKeyring
+	}
+
+	var opened requestImpl
+	if err := k.open(r.Seal, &opened); err != nil {
+		return nil, err
+	}
+
+	s := r.Seal
+	*r = opened
+	return s, nil
+}
+
+//checkReplay rejects a sealed request that is older than the replay window, or that is delivered under another id
+//than the one it's sealed with
+func (k *Keyring) checkReplay(id string, s *sealed) error {
+	if k == nil || s == nil {
+		return nil
+	}
+
+	if time.Since(time.Unix(0, s.Issued)) > k.replayWindow() {
+		return ErrReplayed
+	}
+
+	if s.ID != "" && s.ID != id {
+		return ErrReplayed
+	}
+
+	return nil
+}
+
+func replayKey(s *sealed) string {
+	return fmt.Sprintf(sealReplayTmpl, hex.EncodeToString(s.Token))
+}
+
+//claimReplay claims the token of a sealed request before it's run, if the store is an IdempotencyStore. The claim
+//expires after a short pending time, so the request can be run again if the worker dies before it's bound. It
+//returns ErrReplayPending if another worker holds the claim, and ErrReplayed if the request already ran.
+func (k *Keyring) claimReplay(store ResultStore, s *sealed) (bool, error) {
+	idempotency, ok := store.(IdempotencyStore)
+	if k == nil || s == nil || !ok {
+		return false, nil
+	}
+
+	claimed, bound, err := idempotency.Claim(replayKey(s), idempotencyPending)
+	switch {
+	case err != nil:
+		return false, err
+	case claimed:
+		return true, nil
+	case bound == "":
+		return false, ErrReplayPending
+	}
+
+	return false, ErrReplayed
+}
+
+//bindReplay keeps the claimed token of a request that ran for the whole replay window
+func (k *Keyring) bindReplay(store ResultStore, id string, s *sealed) error {
+	return store.(IdempotencyStore).Bind(replayKey(s), id, k.replayWindow())
+}
+
+//sealResponse moves the response details in a sealed payload, only the fields used by the stores indexes are
+//kept in the clear
+func (k *Keyring) sealResponse(response *Response) error {
+	if k == nil {
+		return nil
+	}
+
+	s, err := k.seal(k.resultKeyID(), "", response)
+	if err != nil {
+		return err
+	}
+
+	*response = Response{
+		UUID:       response.UUID,
+		ParentUUID: response.ParentUUID,
+		State:      response.State,
+		Seal:       s,
+	}
+
+	return nil
+}
+
+//openResponse verifies the response and restores its sealed details
+func (k *Keyring) openResponse(response *Response) error {
+	if response.Seal == nil {
+		if k != nil {
+			return ErrUnsigned
+		}
+		return nil
+	}
+
+	if k == nil {
+		return ErrNoKeyring
+	}
+
+	var opened Response
+	if err := k.open(response.Seal, &opened); err != nil {
+		return err
+	}
+
+	//a valid response of another task can't be swapped in
+	if opened.UUID != response.UUID || opened.State != response.State {
+		return ErrInvalidSignature
+	}
+
+	*response = opened
+	return nil
+}
+
+//sealProgress moves the progress of the task id in a sealed payload, only its time is kept in the clear
+func (k *Keyring) sealProgress(id string, progress *Progress) error {
+	if k == nil {
+		return nil
+	}
+
+	s, err := k.seal(k.resultKeyID(), id, progress)
+	if err != nil {
+		return err
+	}
+
+	*progress = Progress{
+		Time: progress.Time,
+		Seal: s,
+	}
+
+	return nil
+}
+
+//openProgress verifies the progress of the task id and restores its sealed details
+func (k *Keyring) openProgress(id string, progress *Progress) error {
+	if progress.Seal == nil {
+		if k != nil {
+			return ErrUnsigned
+		}
+		return nil
+	}
+
+	if k == nil {
+		return ErrNoKeyring
+	}
+
+	var opened Progress
+	if err := k.open(progress.Seal, &opened); err != nil {
+		return err
+	}
+
+	//the progress of another task can't be swapped in
+	if progress.Seal.ID != id {
+		return ErrInvalidSignature
+	}
+
+	*progress = opened
+	return nil
+}
+
+//sealValue returns a value emitted by the task id as a sealed payload, a nil keyring doesn't seal
+func (k *Keyring) sealValue(id string, value interface{}) (interface{}, error) {
+	if k == nil {
+		return value, nil
+	}
+
+	return k.seal(k.resultKeyID(), id, &streamValue{Value: value})
+}
+
+//openValue verifies a value emitted by the task id and returns its sealed value
+func (k *Keyring) openValue(id string, value interface{}) (interface{}, error) {
+	s, ok := value.(*sealed)
+	switch {
+	case !ok && k != nil:
+		return nil, ErrUnsigned
+	case !ok:
+		return value, nil
+	case k == nil:
+		return nil, ErrNoKeyring
+	}
+
+	var opened streamValue
+	if err := k.open(s, &opened); err != nil {
+		return nil, err
+	}
+
+	if s.ID != id {
+		return nil, ErrInvalidSignature
+	}
+
+	return opened.Value, nil
+}
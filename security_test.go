@@ -0,0 +1,414 @@
+package wfe
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"strings"
+	"testing"
+	"time"
+)
+
+func securityAddTest(c *Context, a, b int) int {
+	return a + b
+}
+
+func securityTestKeyring() *Keyring {
+	return &Keyring{
+		KeyID: "k2",
+		Keys: map[string]*SecurityKey{
+			"k1": {Secret: []byte("old secret")},
+			"k2": {Secret: []byte("new secret"), Cipher: []byte("0123456789abcdef")},
+		},
+	}
+}
+
+func TestKeyringSealOpen(t *testing.T) {
+	keyring := securityTestKeyring()
+	req := MustCall(securityAddTest, 1, 2)
+
+	envelope, err := keyring.sealRequest(req, "")
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	sealed := envelope.(*requestImpl)
+	if ok := assert.Empty(t, sealed.Function); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.NotNil(t, sealed.Seal.Nonce); !ok {
+		t.Fatal()
+	}
+
+	seal, err := keyring.openRequest(sealed)
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Len(t, seal.Token, sealTokenSize); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, req, sealed); !ok {
+		t.Fatal()
+	}
+
+	//messages sealed with a previous key are still accepted
+	keyring.KeyID = "k1"
+	envelope, _ = keyring.sealRequest(req, "")
+	keyring.KeyID = "k2"
+	_, err = keyring.openRequest(envelope.(*requestImpl))
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+}
+
+func TestKeyringReject(t *testing.T) {
+	keyring := securityTestKeyring()
+
+	open := func(r *requestImpl) error {
+		_, err := keyring.openRequest(r)
+		return err
+	}
+
+	if ok := assert.Equal(t, ErrUnsigned, open(&requestImpl{Function: "fn"})); !ok {
+		t.Fatal()
+	}
+
+	envelope, _ := keyring.sealRequest(MustCall(securityAddTest, 1, 2), "")
+	sealed := envelope.(*requestImpl)
+	sealed.Seal.Payload[0] ^= 0xff
+	if ok := assert.Equal(t, ErrInvalidSignature, open(sealed)); !ok {
+		t.Fatal()
+	}
+
+	envelope, _ = keyring.sealRequest(MustCall(securityAddTest, 1, 2), "")
+	sealed = envelope.(*requestImpl)
+	sealed.Seal.KeyID = "k3"
+	if ok := assert.True(t, errors.Is(open(sealed), ErrUnknownKey)); !ok {
+		t.Fatal()
+	}
+
+	_, err := (*Keyring)(nil).openRequest(sealed)
+	if ok := assert.Equal(t, ErrNoKeyring, err); !ok {
+		t.Fatal()
+	}
+}
+
+func TestKeyringCompress(t *testing.T) {
+	keyring := securityTestKeyring()
+	req := &requestImpl{
+		Function:  "large",
+		Arguments: []interface{}{strings.Repeat("x", 4096)},
+	}
+
+	envelope, err := keyring.sealRequest(req, "")
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	plain := len(envelope.(*requestImpl).Seal.Payload)
+
+	//the payload is compressed before it's encrypted
+	keyring.Compress = "gzip"
+	envelope, err = keyring.sealRequest(req, "")
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.True(t, len(envelope.(*requestImpl).Seal.Payload) < plain/10); !ok {
+		t.Fatal()
+	}
+
+	//the payloads are opened whatever the compression of the opening side is
+	keyring.Compress = ""
+	_, err = keyring.openRequest(envelope.(*requestImpl))
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, req, envelope); !ok {
+		t.Fatal()
+	}
+
+	keyring.Compress = "lzma"
+	_, err = keyring.sealRequest(req, "")
+	if ok := assert.Error(t, err); !ok {
+		t.Fatal()
+	}
+}
+
+func TestKeyringEd25519(t *testing.T) {
+	clientPublic, clientPrivate, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	workerPublic, workerPrivate, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//each side only holds the public key of the other
+	client := &Keyring{KeyID: "client", ResultKeyID: "worker", Keys: map[string]*SecurityKey{
+		"client": {PrivateKey: clientPrivate},
+		"worker": {PublicKey: workerPublic},
+	}}
+	worker := &Keyring{KeyID: "client", ResultKeyID: "worker", Keys: map[string]*SecurityKey{
+		"client": {PublicKey: clientPublic},
+		"worker": {PrivateKey: workerPrivate},
+	}}
+
+	envelope, err := client.sealRequest(MustCall(securityAddTest, 1, 2), "")
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	_, err = worker.openRequest(envelope.(*requestImpl))
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	response := &Response{UUID: "1234", State: StateSuccess, Result: 3}
+	if ok := assert.Nil(t, worker.sealResponse(response)); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Nil(t, response.Result); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Nil(t, client.openResponse(response)); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, 3, response.Result); !ok {
+		t.Fatal()
+	}
+
+	//a verifier can't seal
+	if ok := assert.Error(t, client.sealResponse(response)); !ok {
+		t.Fatal()
+	}
+}
+
+func TestHandleDeliveryUnsigned(t *testing.T) {
+	Register(securityAddTest)
+
+	keyring := securityTestKeyring()
+	store := &testStore{}
+	eng := &Engine{store: store, keyring: keyring}
+
+	d := testDelivery{val: requestImpl{
+		Function:  "github.com/conictus/wfe.securityAddTest",
+		Arguments: []interface{}{1, 2},
+	}}
+
+	d.On("ID").Return("1234")
+	d.On("Confirm").Return(nil)
+
+	store.On("Set", mock.MatchedBy(func(r *Response) bool {
+		opened := *r
+		return keyring.openResponse(&opened) == nil && opened.State == StateError && opened.Error == ErrUnsigned.Error()
+	})).Return(nil)
+
+	if ok := assert.Equal(t, ErrUnsigned, eng.handleDelivery(&d)); !ok {
+		t.Fatal()
+	}
+
+	if ok := store.AssertExpectations(t); !ok {
+		t.Fatal()
+	}
+}
+
+func TestHandleDeliverySigned(t *testing.T) {
+	Register(securityAddTest)
+
+	keyring := securityTestKeyring()
+	store := &testStore{}
+	eng := &Engine{store: store, keyring: keyring}
+
+	envelope, _ := keyring.sealRequest(MustCall(securityAddTest, 1, 2), "")
+	d := testDelivery{val: *envelope.(*requestImpl)}
+
+	d.On("ID").Return("1234")
+	d.On("Confirm").Return(nil)
+
+	store.On("Claim", mock.Anything, idempotencyPending).Return(true, "", nil)
+	store.On("Bind", mock.Anything, "1234", DefaultReplayWindow).Return(nil)
+	store.On("Set", mock.MatchedBy(func(r *Response) bool {
+		opened := *r
+		return r.Result == nil && keyring.openResponse(&opened) == nil && opened.Result == 3
+	})).Return(nil)
+
+	if ok := assert.Nil(t, eng.handleDelivery(&d)); !ok {
+		t.Fatal()
+	}
+
+	if ok := store.AssertExpectations(t); !ok {
+		t.Fatal()
+	}
+}
+
+func TestHandleDeliveryReplayed(t *testing.T) {
+	Register(securityAddTest)
+
+	keyring := securityTestKeyring()
+	store := &testStore{}
+	eng := &Engine{store: store, keyring: keyring}
+
+	envelope, _ := keyring.sealRequest(MustCall(securityAddTest, 1, 2), "")
+	d := testDelivery{val: *envelope.(*requestImpl)}
+
+	d.On("ID").Return("1234")
+	d.On("Confirm").Return(nil)
+
+	//the request already ran, its result is not overwritten
+	store.On("Claim", mock.Anything, idempotencyPending).Return(false, "1234", nil)
+
+	if ok := assert.Equal(t, ErrReplayed, eng.handleDelivery(&d)); !ok {
+		t.Fatal()
+	}
+
+	//requests sealed before the replay window are rejected
+	envelope.(*requestImpl).Seal.Issued = time.Now().Add(-2 * DefaultReplayWindow).UnixNano()
+	if ok := assert.Equal(t, ErrReplayed, keyring.checkReplay("1234", envelope.(*requestImpl).Seal)); !ok {
+		t.Fatal()
+	}
+
+	if ok := store.AssertExpectations(t); !ok {
+		t.Fatal()
+	}
+
+	d.AssertNotCalled(t, "Requeue")
+}
+
+func TestHandleDeliveryReplayedID(t *testing.T) {
+	Register(securityAddTest)
+
+	keyring := securityTestKeyring()
+	store := &testStore{}
+	eng := &Engine{store: store, keyring: keyring}
+
+	//the request is sealed for the message 1234, and published again as 5678
+	envelope, _ := keyring.sealRequest(MustCall(securityAddTest, 1, 2), "1234")
+	d := testDelivery{val: *envelope.(*requestImpl)}
+
+	d.On("ID").Return("5678")
+	d.On("Confirm").Return(nil)
+
+	store.On("Set", mock.MatchedBy(func(r *Response) bool {
+		opened := *r
+		return keyring.openResponse(&opened) == nil && opened.Error == ErrReplayed.Error()
+	})).Return(nil)
+
+	if ok := assert.Equal(t, ErrReplayed, eng.handleDelivery(&d)); !ok {
+		t.Fatal()
+	}
+
+	//the sealed id can't be changed
+	envelope.(*requestImpl).Seal.ID = "5678"
+	if ok := assert.Equal(t, ErrInvalidSignature, keyring.open(envelope.(*requestImpl).Seal, &requestImpl{})); !ok {
+		t.Fatal()
+	}
+
+	if ok := store.AssertExpectations(t); !ok {
+		t.Fatal()
+	}
+
+	store.AssertNotCalled(t, "Claim", mock.Anything, mock.Anything)
+}
+
+func TestClientSealMessageID(t *testing.T) {
+	Register(securityAddTest)
+
+	keyring := securityTestKeyring()
+	dispatcher := &testIDDispatcher{}
+	client := &clientImpl{dispatcher: dispatcher, store: &testStore{}, keyring: keyring}
+
+	dispatcher.On("DispatchID", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+
+	result, err := client.Apply(MustCall(securityAddTest, 1, 2))
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	msg := dispatcher.Calls[0].Arguments.Get(1).(*Message)
+	id := dispatcher.Calls[0].Arguments.String(2)
+	if ok := assert.Equal(t, id, result.ID()); !ok {
+		t.Fatal()
+	}
+
+	//the request is sealed for the message id it's dispatched as
+	seal := msg.Content.(*requestImpl).Seal
+	if ok := assert.Equal(t, id, seal.ID); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Nil(t, keyring.checkReplay(id, seal)); !ok {
+		t.Fatal()
+	}
+}
+
+func TestHandleDeliveryReplayPending(t *testing.T) {
+	Register(securityAddTest)
+
+	keyring := securityTestKeyring()
+	store := &testStore{}
+	eng := &Engine{store: store, keyring: keyring}
+
+	envelope, _ := keyring.sealRequest(MustCall(securityAddTest, 1, 2), "")
+	d := testDelivery{val: *envelope.(*requestImpl)}
+
+	d.On("ID").Return("1234")
+	d.On("Requeue").Return(nil)
+
+	//the worker that claimed the request died before it stored the result, the claim expires so the redelivery
+	//is held and requeued instead of rejected
+	store.On("Claim", mock.Anything, idempotencyPending).Return(false, "", nil)
+
+	if ok := assert.Nil(t, eng.handleDelivery(&d)); !ok {
+		t.Fatal()
+	}
+
+	if ok := d.AssertExpectations(t); !ok {
+		t.Fatal()
+	}
+
+	d.AssertNotCalled(t, "Confirm")
+	store.AssertNotCalled(t, "Set", mock.Anything)
+}
+
+func TestHandleDeliverySealError(t *testing.T) {
+	Register(securityAddTest)
+
+	keyring := securityTestKeyring()
+	store := &testStore{}
+
+	//the worker can't seal the results
+	worker := securityTestKeyring()
+	worker.ResultKeyID = "k3"
+	eng := &Engine{store: store, keyring: worker}
+
+	envelope, _ := keyring.sealRequest(MustCall(securityAddTest, 1, 2), "")
+	d := testDelivery{val: *envelope.(*requestImpl)}
+
+	d.On("ID").Return("1234")
+	d.On("Confirm").Return(nil)
+
+	store.On("Claim", mock.Anything, idempotencyPending).Return(true, "", nil)
+	store.On("Bind", mock.Anything, "1234", DefaultReplayWindow).Return(nil)
+	store.On("Set", mock.MatchedBy(func(r *Response) bool {
+		return r.State == StateError && r.Result == nil && r.Seal == nil
+	})).Return(nil)
+
+	if ok := assert.Nil(t, eng.handleDelivery(&d)); !ok {
+		t.Fatal()
+	}
+
+	if ok := store.AssertExpectations(t); !ok {
+		t.Fatal()
+	}
+}
@@ -0,0 +1,249 @@
+package wfe
+
+import (
+	"fmt"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func sqliteTestStore(t *testing.T, params string) (ResultStore, func()) {
+	dir, err := ioutil.TempDir("", "wfe")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o := Options{
+		Store: fmt.Sprintf("sqlite://%s?%s", filepath.Join(dir, "results.db"), params),
+	}
+
+	store, err := o.GetStore()
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	return store, func() {
+		store.(*sqlStore).Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSQLStoreSetGet(t *testing.T) {
+	store, done := sqliteTestStore(t, "")
+	defer done()
+
+	r := &Response{
+		UUID:   "1234",
+		State:  StateSuccess,
+		Error:  "error",
+		Result: 123,
+	}
+
+	if ok := assert.Nil(t, store.Set(r)); !ok {
+		t.Fatal()
+	}
+
+	resp, err := store.Get("1234", DefaultTimeout)
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, r, resp); !ok {
+		t.Fatal()
+	}
+
+	//a second Set replaces the response
+	r.State = StateError
+	if ok := assert.Nil(t, store.Set(r)); !ok {
+		t.Fatal()
+	}
+
+	resp, err = store.Get("1234", DefaultTimeout)
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, StateError, resp.State); !ok {
+		t.Fatal()
+	}
+}
+
+func TestSQLStoreGetWait(t *testing.T) {
+	store, done := sqliteTestStore(t, "")
+	defer done()
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		store.Set(&Response{UUID: "1234", State: StateSuccess, Result: 1})
+	}()
+
+	ts := time.Now()
+	resp, err := store.Get("1234", 5)
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, 1, resp.Result); !ok {
+		t.Fatal()
+	}
+
+	//woken up by the in process notification, before the poll interval
+	if ok := assert.True(t, time.Since(ts) < sqlPollInterval); !ok {
+		t.Fatal()
+	}
+}
+
+type sqlTestListener struct {
+	channel string
+	notify  chan string
+	closed  bool
+}
+
+func (l *sqlTestListener) Notify() <-chan string {
+	return l.notify
+}
+
+func (l *sqlTestListener) Close() error {
+	l.closed = true
+	return nil
+}
+
+func TestSQLStoreListener(t *testing.T) {
+	listener := &sqlTestListener{notify: make(chan string)}
+	RegisterSQLListener("sqlite3", func(dsn string, channel string) (SQLListener, error) {
+		listener.channel = channel
+		return listener, nil
+	})
+
+	defer func() {
+		slm.Lock()
+		delete(sqlListeners, "sqlite3")
+		slm.Unlock()
+	}()
+
+	store, done := sqliteTestStore(t, "")
+
+	if ok := assert.Equal(t, DefaultSQLTable, listener.channel); !ok {
+		t.Fatal()
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		store.Set(&Response{UUID: "1234", State: StateSuccess, Result: 1})
+		listener.notify <- "1234"
+	}()
+
+	ts := time.Now()
+	resp, err := store.Get("1234", 5)
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, 1, resp.Result); !ok {
+		t.Fatal()
+	}
+
+	//woken up by the listener notification, before the poll interval
+	if ok := assert.True(t, time.Since(ts) < sqlPollInterval); !ok {
+		t.Fatal()
+	}
+
+	done()
+	if ok := assert.True(t, listener.closed); !ok {
+		t.Fatal()
+	}
+
+	//closing twice is fine
+	if ok := assert.Nil(t, store.(*sqlStore).Close()); !ok {
+		t.Fatal()
+	}
+}
+
+func TestSQLStoreGetTimeout(t *testing.T) {
+	store, done := sqliteTestStore(t, "timeout=1")
+	defer done()
+
+	ts := time.Now()
+	_, err := store.Get("does not exist", DefaultTimeout)
+	if ok := assert.Equal(t, ErrTimeout, err); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.InDelta(t, int64(time.Second), int64(time.Since(ts)), float64(500*time.Millisecond)); !ok {
+		t.Fatal()
+	}
+}
+
+func TestSQLStoreExpire(t *testing.T) {
+	store, done := sqliteTestStore(t, "keep=1")
+	defer done()
+
+	if ok := assert.Nil(t, store.Set(&Response{UUID: "1234", State: StateSuccess})); !ok {
+		t.Fatal()
+	}
+
+	time.Sleep(2500 * time.Millisecond)
+
+	_, err := store.Get("1234", 1)
+	if ok := assert.Equal(t, ErrTimeout, err); !ok {
+		t.Fatal()
+	}
+
+	var count int
+	store.(*sqlStore).db.QueryRow("SELECT COUNT(*) FROM wfe_results").Scan(&count)
+	if ok := assert.Equal(t, 0, count); !ok {
+		t.Fatal()
+	}
+}
+
+func TestSQLStoreManage(t *testing.T) {
+	s, done := sqliteTestStore(t, "")
+	defer done()
+	store := s.(*sqlStore)
+
+	for i, state := range []string{StateSuccess, StateError, StateSuccess} {
+		r := &Response{UUID: fmt.Sprintf("id-%d", i), ParentUUID: "parent", State: state}
+		if ok := assert.Nil(t, store.Set(r)); !ok {
+			t.Fatal()
+		}
+	}
+
+	resps, err := store.GetMany([]string{"id-2", "id-0"}, 1)
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, "id-2", resps[0].UUID); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, "id-0", resps[1].UUID); !ok {
+		t.Fatal()
+	}
+
+	resps, err = store.List(ResultFilter{State: StateSuccess, ParentID: "parent", Limit: 1})
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Len(t, resps, 1); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, "id-0", resps[0].UUID); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Nil(t, store.Forget("id-1")); !ok {
+		t.Fatal()
+	}
+
+	_, err = store.Peek("id-1")
+	if ok := assert.Equal(t, ErrNotFound, err); !ok {
+		t.Fatal()
+	}
+}
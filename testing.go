@@ -2,6 +2,7 @@ package wfe
 
 import (
 	"github.com/stretchr/testify/mock"
+	"time"
 )
 
 type testBroker struct {
@@ -37,6 +38,15 @@ func (d *testDispatcher) Dispatch(o *RouteOptions, m *Message) (string, error) {
 	return args.String(0), args.Error(1)
 }
 
+type testIDDispatcher struct {
+	testDispatcher
+}
+
+func (d *testIDDispatcher) DispatchID(o *RouteOptions, m *Message, id string) error {
+	args := d.Called(o, m, id)
+	return args.Error(0)
+}
+
 type testConsumer struct {
 	mock.Mock
 }
@@ -71,6 +81,26 @@ func (t *testStore) Get(id string, timeout int) (*Response, error) {
 	return r, args.Error(1)
 }
 
+func (t *testStore) Claim(key string, pending time.Duration) (bool, string, error) {
+	args := t.Called(key, pending)
+	return args.Bool(0), args.String(1), args.Error(2)
+}
+
+func (t *testStore) Bind(key string, id string, window time.Duration) error {
+	args := t.Called(key, id, window)
+	return args.Error(0)
+}
+
+func (t *testStore) Release(key string) error {
+	args := t.Called(key)
+	return args.Error(0)
+}
+
+func (t *testStore) Completed(id string) (bool, error) {
+	args := t.Called(id)
+	return args.Bool(0), args.Error(1)
+}
+
 func NewTestContext(id string, client Client) *Context {
 	return &Context{
 		id:     id,
@@ -149,6 +179,11 @@ func (tc *TestClient) ResultFor(id string) Result {
 	return r.(Result)
 }
 
+func (tc *TestClient) Forget(id string) error {
+	args := tc.Called(id)
+	return args.Error(0)
+}
+
 func (tc *TestClient) Close() error {
 	args := tc.Called()
 	return args.Error(0)
@@ -177,6 +212,10 @@ func (dc *DummyClient) ResultFor(id string) Result {
 	return nil
 }
 
+func (dc *DummyClient) Forget(id string) error {
+	return nil
+}
+
 func (dc *DummyClient) Close() error {
 	return nil
 }
@@ -10,7 +10,9 @@ import (
 	"errors"
 	"fmt"
 	"github.com/op/go-logging"
+	"os"
 	"runtime/debug"
+	"strings"
 	"sync"
 	"time"
 )
@@ -21,29 +23,68 @@ var (
 	//ErrUnknownFunction returned by the engine if a client is calling an unregistered function
 	ErrUnknownFunction = errors.New("unkonwn function")
 
-	DefaultQueue = Queue{DefaultQueueName, 1000}
+	DefaultQueue = Queue{Name: DefaultQueueName, Workers: 1000}
+)
+
+const (
+	//DefaultRequeueLimit number of times a request of another task version is requeued, see Options.RequeueLimit
+	DefaultRequeueLimit = 10
+
+	//advertiseInterval how often a worker advertises its registry again, if the result store retention is not known
+	advertiseInterval = 5 * time.Minute
+
+	//requeueDelay how long a worker holds a request of another task version before it requeues it, doubled on
+	//each redelivery up to requeueDelayMax
+	requeueDelay    = 500 * time.Millisecond
+	requeueDelayMax = time.Minute
 )
 
 //Engine is responsible for running the tasks concurrently. It processes users messages and executes them
 type Engine struct {
-	opt    *Options
-	store  ResultStore
-	graph  GraphBackend
-	queues []Queue
+	opt     *Options
+	store   ResultStore
+	graph   GraphBackend
+	blobs   *offloader
+	keyring *Keyring
+	queues  []Queue
 
 	mw         middlewareStack
 	dispatcher Dispatcher
+
+	done  chan struct{}
+	close sync.Once
 }
 
 type Queue struct {
 	Name    string
 	Workers int
+	//Prefetch maximum number of unconfirmed messages the queue consumer holds, defaults to Workers so the messages
+	//go to the idle worker processes (fair dispatch). Set it to -1 to disable the limit
+	Prefetch int
+
+	//Exchange the queue is bound to, if the tasks are routed by an exchange (see OnExchange)
+	Exchange string
+	//ExchangeType of the exchange, `direct` (default), `fanout` or `topic`
+	ExchangeType string
+	//Bindings routing keys (or topic patterns like `tenant.acme.#`) the queue is bound with
+	Bindings []string
 }
 
 func (q Queue) String() string {
 	return fmt.Sprintf("%s:%d", q.Name, q.Workers)
 }
 
+func (q Queue) prefetch() int {
+	switch {
+	case q.Prefetch < 0:
+		return 0
+	case q.Prefetch == 0:
+		return q.Workers
+	}
+
+	return q.Prefetch
+}
+
 /*
 New creates a new engine with the given options and the number of workers routines. The number of workers routines
 controllers how many parallel tasks can be run concurrently on this engine instance.
@@ -59,11 +100,19 @@ func New(o *Options, queues ...Queue) (*Engine, error) {
 		return nil, err
 	}
 
+	blobs, err := newOffloader(o)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Engine{
-		opt:    o,
-		store:  store,
-		graph:  graph,
-		queues: queues,
+		opt:     o,
+		store:   store,
+		graph:   graph,
+		blobs:   blobs,
+		keyring: o.Keyring,
+		queues:  queues,
+		done:    make(chan struct{}),
 	}, nil
 }
 
@@ -72,10 +121,14 @@ func (e *Engine) newContext(id string, req Request) *Context {
 		client: &clientImpl{
 			dispatcher: e.dispatcher,
 			store:      e.store,
+			blobs:      e.blobs,
+			keyring:    e.keyring,
 			parentID:   id,
 		},
-		id:     id,
-		values: make(map[string]interface{}),
+		store:   e.store,
+		keyring: e.keyring,
+		id:      id,
+		values:  make(map[string]interface{}),
 	}
 }
 
@@ -88,10 +141,21 @@ func (e *Engine) handle(id string, req Request) (interface{}, error) {
 }
 
 func (e *Engine) handleDelivery(delivery Delivery) error {
+	requeued, duplicate := false, false
+	//blob offloaded arguments of the request, deleted once the message is confirmed
+	var blob string
 	defer func() {
+		if requeued {
+			return
+		}
+
 		//we discard the message anyway
 		if err := delivery.Confirm(); err != nil {
 			log.Errorf("Failed to acknowledge message processing %s", err)
+		} else if blob != "" {
+			if err := e.blobs.delete(blob); err != nil {
+				log.Errorf("Failed to delete arguments of message '%s': %s", delivery.ID(), err)
+			}
 		}
 	}()
 
@@ -101,19 +165,46 @@ func (e *Engine) handleDelivery(delivery Delivery) error {
 	}
 
 	var graph Graph
+	//bind the seal of the request once its response is stored
+	var bind *sealed
 	defer func() {
 		if err := recover(); err != nil {
-			debug.PrintStack()
+			stack := debug.Stack()
+
+			log.Errorf("Message '%s' paniced: %s\n%s", delivery.ID(), err, stack)
+			response.SetError(newTaskError(err, stack))
+		}
 
-			log.Errorf("Message '%s' paniced: %s", delivery.ID(), err)
-			response.State = StateError
-			response.Error = fmt.Sprintf("%v", err)
+		if requeued || duplicate {
+			return
+		}
+
+		if err := e.blobs.response(e.store, response); err != nil {
+			log.Errorf("Failed to offload result for id (%s): %s", response.UUID, err)
+			response.SetError(newTaskError(err, nil))
+			response.Result = nil
+		}
+
+		if err := e.keyring.sealResponse(response); err != nil {
+			//the result is not stored in the clear, the clients get an error instead
+			log.Errorf("Failed to seal response for id (%s): %s", response.UUID, err)
+			*response = Response{
+				UUID:       response.UUID,
+				ParentUUID: response.ParentUUID,
+			}
+			response.SetError(newTaskError(err, nil))
 		}
 
 		if err := e.store.Set(response); err != nil {
 			log.Errorf("Failed to send response for id (%s): %s", response.UUID, err)
 		}
 
+		if bind != nil {
+			if err := e.keyring.bindReplay(e.store, delivery.ID(), bind); err != nil {
+				log.Errorf("Failed to bind message '%s': %s", delivery.ID(), err)
+			}
+		}
+
 		if graph != nil {
 			graph.Commit(response)
 		}
@@ -121,7 +212,78 @@ func (e *Engine) handleDelivery(delivery Delivery) error {
 
 	var req requestImpl
 	if err := delivery.Content(&req); err != nil {
-		response.Error = err.Error()
+		response.SetError(newTaskError(err, nil))
+		return err
+	}
+
+	//unsigned, tampered or replayed messages are rejected before anything else
+	seal, err := e.keyring.openRequest(&req)
+	if err == nil {
+		err = e.keyring.checkReplay(delivery.ID(), seal)
+	}
+
+	if err != nil {
+		log.Errorf("Message '%s' rejected: %s", delivery.ID(), err)
+		response.SetError(newTaskError(err, nil))
+		return err
+	}
+
+	response.ParentUUID = req.ParentID()
+	blob = req.Blob
+
+	//stale work is not run, for example notifications queued during an outage
+	if req.expired(time.Now()) {
+		log.Warningf("Message '%s' expired at %s", delivery.ID(), req.ExpiresAt)
+		response.SetError(newTaskError(ErrExpired, nil))
+		response.State = StateExpired
+		return ErrExpired
+	}
+
+	if err := e.blobs.loadRequest(&req); err != nil {
+		response.SetError(newTaskError(err, nil))
+		return err
+	}
+
+	if err := req.checkVersion(); err != nil && e.opt != nil && e.opt.RequeueVersionMismatch {
+		if requeued = e.requeue(delivery, e.opt.requeueLimit(), err); requeued {
+			return nil
+		}
+	}
+
+	if req.Key != "" {
+		if store, ok := e.store.(IdempotencyStore); ok {
+			if done, err := store.Completed(delivery.ID()); err != nil {
+				log.Errorf("Failed to check completion of message '%s': %s", delivery.ID(), err)
+			} else if done {
+				//the broker redelivered a message that is already processed.
+				log.Warningf("Message '%s' is already completed, skipping", delivery.ID())
+				duplicate = true
+				return nil
+			}
+		}
+	}
+
+	//the token of a sealed request is claimed while it runs, and bound once the response is stored
+	claimed, err := e.keyring.claimReplay(e.store, seal)
+	switch err {
+	case nil:
+		if claimed {
+			bind = seal
+		}
+	case ErrReplayPending:
+		//the worker holding the claim may have died, the message is held until the claim expires
+		if requeued = e.requeue(delivery, e.requeueLimit(), err); !requeued {
+			log.Warningf("Message '%s' is run by another worker, skipping", delivery.ID())
+			duplicate = true
+		}
+		return nil
+	case ErrReplayed:
+		//the result of the first run is kept
+		log.Errorf("Message '%s' rejected: %s", delivery.ID(), err)
+		duplicate = true
+		return err
+	default:
+		response.SetError(newTaskError(err, nil))
 		return err
 	}
 
@@ -131,7 +293,7 @@ func (e *Engine) handleDelivery(delivery Delivery) error {
 
 	result, err := e.handle(delivery.ID(), &req)
 	if err != nil {
-		response.Error = err.Error()
+		response.SetError(newTaskError(err, nil))
 		return err
 	}
 
@@ -161,8 +323,12 @@ func (e *Engine) startWorkers(number int) chan<- Delivery {
 
 func (e *Engine) getRequestsQueue(broker Broker, queue Queue) (<-chan Delivery, error) {
 	consumer, err := broker.Consumer(&RouteOptions{
-		Queue:   queue.Name,
-		Durable: true,
+		Queue:        queue.Name,
+		Durable:      true,
+		Exchange:     queue.Exchange,
+		ExchangeType: queue.ExchangeType,
+		Bindings:     queue.Bindings,
+		Prefetch:     queue.prefetch(),
 	})
 
 	if err != nil {
@@ -178,12 +344,59 @@ func (e *Engine) getRequestsQueue(broker Broker, queue Queue) (<-chan Delivery,
 	return requests, nil
 }
 
+//requeue holds the delivery for the backoff of its redeliveries, then requeues it. It returns false if the delivery
+//can't be requeued, or was redelivered limit times already
+func (e *Engine) requeue(delivery Delivery, limit int, reason error) bool {
+	redeliveries := 0
+	if r, ok := delivery.(Redeliverer); ok {
+		redeliveries = r.Redeliveries()
+	}
+
+	r, ok := delivery.(Requeuer)
+	if !ok || redeliveries >= limit {
+		return false
+	}
+
+	//the workers would spin on the request if it was requeued right away
+	time.Sleep(requeueBackoff(redeliveries))
+
+	log.Warningf("Requeue message '%s': %s", delivery.ID(), reason)
+	if err := r.Requeue(); err != nil {
+		log.Errorf("Failed to requeue message '%s': %s", delivery.ID(), err)
+		return false
+	}
+
+	return true
+}
+
+func (e *Engine) requeueLimit() int {
+	if e.opt == nil {
+		return DefaultRequeueLimit
+	}
+
+	return e.opt.requeueLimit()
+}
+
+//requeueBackoff returns how long a request is held before it's requeued again
+func requeueBackoff(redeliveries int) time.Duration {
+	backoff := requeueDelay
+	for i := 0; i < redeliveries && backoff < requeueDelayMax; i++ {
+		backoff *= 2
+	}
+
+	if backoff > requeueDelayMax {
+		return requeueDelayMax
+	}
+
+	return backoff
+}
+
 //Use a middleware
 func (e *Engine) Use(m Middleware) {
 	e.mw = append(e.mw, m)
 }
 
-func (e *Engine) runQueue(ctx context.Context, wg *sync.WaitGroup, broker Broker, queue Queue) {
+func (e *Engine) runQueue(ctx context.Context, died chan<- Queue, broker Broker, queue Queue) {
 	requests, err := e.getRequestsQueue(broker, queue)
 	if err != nil {
 		log.Errorf("Faile to get queue '%v' delivereis", queue)
@@ -200,15 +413,61 @@ func (e *Engine) runQueue(ctx context.Context, wg *sync.WaitGroup, broker Broker
 		}
 	}
 
-	wg.Done()
+	died <- queue
 }
 
-//Run start processing messages.
+//advertise publishes the tasks registry of this worker to the result store, if the store supports it. The registry
+//is published again every half of the store retention (or every advertiseInterval), so it only expires once the
+//worker is gone, or the engine is closed.
+func (e *Engine) advertise() {
+	advertiser, ok := e.store.(RegistryAdvertiser)
+	if !ok {
+		return
+	}
+
+	host, _ := os.Hostname()
+	worker := fmt.Sprintf("%s.%d", host, os.Getpid())
+	publish := func() {
+		if err := advertiser.Advertise(worker, Registry()); err != nil {
+			log.Errorf("Failed to advertise worker registry: %s", err)
+		}
+	}
+
+	publish()
+
+	interval := advertiseInterval
+	if r, ok := e.store.(resultRetention); ok && r.retention() > 0 {
+		interval = r.retention() / 2
+	}
+
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				publish()
+			case <-e.done:
+				return
+			}
+		}
+	}()
+}
+
+//Run start processing messages, until the engine is closed.
 func (e *Engine) Run() {
+	e.advertise()
+
 	for {
+		select {
+		case <-e.done:
+			return
+		default:
+		}
+
 		broker, err := e.opt.GetBroker()
 		if err != nil {
-			log.Errorf("Failed to connect to broker '%s': %s", e.opt.Broker, err)
+			log.Errorf("Failed to connect to broker '%s': %s", strings.Join(e.opt.brokerURLs(), ","), err)
 			time.Sleep(3 * time.Second)
 			continue
 		}
@@ -224,14 +483,32 @@ func (e *Engine) Run() {
 
 		ctx := context.Background()
 		ctx, cancel := context.WithCancel(ctx)
-		wg := sync.WaitGroup{}
-		wg.Add(1) //WE ALWAYS ADD ONLY ONE. SO IF ANY DIED, WE CANCEL ALL REMAINING WORKERS.
+		//IF ANY QUEUE DIED, WE CANCEL ALL REMAINING WORKERS.
+		died := make(chan Queue, len(e.queues))
 
 		for _, queue := range e.queues {
-			go e.runQueue(ctx, &wg, broker, queue)
+			go e.runQueue(ctx, died, broker, queue)
 		}
 
-		wg.Wait()
-		cancel()
+		select {
+		case <-died:
+			cancel()
+		case <-e.done:
+			cancel()
+			broker.Close()
+			return
+		}
 	}
 }
+
+//Close stops the engine, Run returns, the worker registry is not advertised anymore and the blob store is closed
+func (e *Engine) Close() error {
+	e.close.Do(func() {
+		close(e.done)
+		if err := e.blobs.close(); err != nil {
+			log.Errorf("Failed to close blob store: %s", err)
+		}
+	})
+
+	return nil
+}
@@ -1,16 +1,28 @@
 package wfe
 
 import (
+	"errors"
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func wfeAddTest(c *Context, a, b int) int {
 	return a + b
 }
 
+func wfeAliasTest(c *Context, a, b int) int {
+	return a + b
+}
+
+func wfeVersionTest(c *Context, a, b int) int {
+	return a + b
+}
+
 type wfeTestStruct struct {
 	s string
 }
@@ -31,6 +43,34 @@ func wfeTestPanic(c *Context) {
 	panic("i paniced")
 }
 
+type wfeTestCodedError struct{}
+
+func (e wfeTestCodedError) Error() string {
+	return "coded error"
+}
+
+func (e wfeTestCodedError) Code() string {
+	return "E42"
+}
+
+func (e wfeTestCodedError) Retryable() bool {
+	return true
+}
+
+func wfeTestReturnOnlyErr(c *Context, a string) error {
+	if a == "fail" {
+		return errors.New("failed")
+	}
+	return nil
+}
+
+func wfeTestReturnErr(c *Context, a int) (int, error) {
+	if a < 0 {
+		return 0, wfeTestCodedError{}
+	}
+	return a, nil
+}
+
 func TestHandleRequestUnknownFn(t *testing.T) {
 	eng := &Engine{}
 
@@ -59,7 +99,6 @@ func TestHandleRequestOk(t *testing.T) {
 }
 
 func TestHandleRequestPtrOk(t *testing.T) {
-	t.Skip("handle request with pointer is broken")
 	Register(wfeTestPtr)
 	eng := &Engine{}
 
@@ -114,6 +153,11 @@ func (d *testDelivery) Confirm() error {
 	return args.Error(0)
 }
 
+func (d *testDelivery) Requeue() error {
+	args := d.Called()
+	return args.Error(0)
+}
+
 func (d *testDelivery) Content(c interface{}) error {
 	val := c.(*requestImpl)
 	*val = d.val
@@ -168,9 +212,10 @@ func TestHandleDeliverHandleErr(t *testing.T) {
 	d.On("Confirm").Return(nil)
 
 	store.On("Set", &Response{
-		UUID:  "1234",
-		State: StateError,
-		Error: ErrUnknownFunction.Error(),
+		UUID:      "1234",
+		State:     StateError,
+		Error:     ErrUnknownFunction.Error(),
+		ErrorType: "*errors.errorString",
 	}).Return(nil)
 
 	err := eng.handleDelivery(&d)
@@ -201,14 +246,195 @@ func TestHandleDeliverHandleFnPanic(t *testing.T) {
 	d.On("ID").Return("1234")
 	d.On("Confirm").Return(nil)
 
+	store.On("Set", mock.MatchedBy(func(r *Response) bool {
+		return r.UUID == "1234" &&
+			r.State == StateError &&
+			r.Error == "i paniced" &&
+			r.ErrorType == "string" &&
+			strings.Contains(r.Stack, "wfeTestPanic")
+	})).Return(nil)
+
+	err := eng.handleDelivery(&d)
+
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	if ok := d.AssertExpectations(t); !ok {
+		t.Fatal()
+	}
+
+	if ok := store.AssertExpectations(t); !ok {
+		t.Fatal()
+	}
+}
+
+func TestHandleRequestReturnOnlyErr(t *testing.T) {
+	Register(wfeTestReturnOnlyErr)
+	eng := &Engine{}
+
+	v, err := eng.handle("", MustCall(wfeTestReturnOnlyErr, "ok"))
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Nil(t, v); !ok {
+		t.Fatal()
+	}
+
+	_, err = eng.handle("", MustCall(wfeTestReturnOnlyErr, "fail"))
+	if ok := assert.EqualError(t, err, "failed"); !ok {
+		t.Fatal()
+	}
+}
+
+func TestHandleRequestReturnErr(t *testing.T) {
+	Register(wfeTestReturnErr)
+	eng := &Engine{}
+
+	v, err := eng.handle("", MustCall(wfeTestReturnErr, 10))
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, 10, v); !ok {
+		t.Fatal()
+	}
+
+	_, err = eng.handle("", MustCall(wfeTestReturnErr, -1))
+	if ok := assert.Equal(t, wfeTestCodedError{}, err); !ok {
+		t.Fatal()
+	}
+}
+
+func TestHandleDeliverHandleFnReturnErr(t *testing.T) {
+	Register(wfeTestReturnErr)
+	store := &testStore{}
+	eng := &Engine{store: store}
+
+	d := testDelivery{val: requestImpl{
+		Function:  "github.com/conictus/wfe.wfeTestReturnErr",
+		Arguments: []interface{}{-1},
+	}}
+
+	d.On("ID").Return("1234")
+	d.On("Confirm").Return(nil)
+
+	store.On("Set", &Response{
+		UUID:      "1234",
+		State:     StateError,
+		Error:     "coded error",
+		ErrorType: "wfe.wfeTestCodedError",
+		ErrorCode: "E42",
+		Retryable: true,
+	}).Return(nil)
+
+	err := eng.handleDelivery(&d)
+
+	if ok := assert.Error(t, err); !ok {
+		t.Fatal()
+	}
+
+	if ok := store.AssertExpectations(t); !ok {
+		t.Fatal()
+	}
+}
+
+func TestHandleDeliverHandleFnReturnOnlyErr(t *testing.T) {
+	Register(wfeTestReturnOnlyErr)
+	store := &testStore{}
+	eng := &Engine{store: store}
+
+	d := testDelivery{val: requestImpl{
+		Function:  "github.com/conictus/wfe.wfeTestReturnOnlyErr",
+		Arguments: []interface{}{"fail"},
+	}}
+
+	d.On("ID").Return("1234")
+	d.On("Confirm").Return(nil)
+
 	store.On("Set", &Response{
-		UUID:  "1234",
-		State: StateError,
-		Error: "i paniced",
+		UUID:      "1234",
+		State:     StateError,
+		Error:     "failed",
+		ErrorType: "*errors.errorString",
 	}).Return(nil)
 
 	err := eng.handleDelivery(&d)
 
+	if ok := assert.EqualError(t, err, "failed"); !ok {
+		t.Fatal()
+	}
+
+	if ok := store.AssertExpectations(t); !ok {
+		t.Fatal()
+	}
+}
+
+func TestHandleRequestAlias(t *testing.T) {
+	RegisterNamed("wfe.test.add", wfeAliasTest, Alias("wfe.test.add.v0"))
+	eng := &Engine{}
+
+	req := requestImpl{
+		Function:  "wfe.test.add.v0",
+		Arguments: []interface{}{1, 2},
+	}
+	v, err := eng.handle("", &req)
+
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Equal(t, 3, v); !ok {
+		t.Fatal()
+	}
+}
+
+func TestHandleDeliverVersionMismatch(t *testing.T) {
+	RegisterNamed("wfe.test.versioned", wfeVersionTest, Version("2"))
+	store := &testStore{}
+	eng := &Engine{store: store}
+
+	d := testDelivery{val: requestImpl{
+		Function:  "wfe.test.versioned",
+		Version:   "1",
+		Arguments: []interface{}{1, 2},
+	}}
+
+	d.On("ID").Return("1234")
+	d.On("Confirm").Return(nil)
+
+	store.On("Set", mock.MatchedBy(func(r *Response) bool {
+		return r.State == StateError && strings.Contains(r.Error, ErrVersionMismatch.Error())
+	})).Return(nil)
+
+	err := eng.handleDelivery(&d)
+
+	if ok := assert.True(t, errors.Is(err, ErrVersionMismatch)); !ok {
+		t.Fatal()
+	}
+
+	if ok := store.AssertExpectations(t); !ok {
+		t.Fatal()
+	}
+}
+
+func TestHandleDeliverVersionRequeue(t *testing.T) {
+	RegisterNamed("wfe.test.versioned", wfeVersionTest, Version("2"))
+	store := &testStore{}
+	eng := &Engine{store: store, opt: &Options{RequeueVersionMismatch: true}}
+
+	d := testDelivery{val: requestImpl{
+		Function:  "wfe.test.versioned",
+		Version:   "1",
+		Arguments: []interface{}{1, 2},
+	}}
+
+	d.On("ID").Return("1234")
+	d.On("Requeue").Return(nil)
+
+	err := eng.handleDelivery(&d)
+
 	if ok := assert.Nil(t, err); !ok {
 		t.Fatal()
 	}
@@ -217,7 +443,173 @@ func TestHandleDeliverHandleFnPanic(t *testing.T) {
 		t.Fatal()
 	}
 
+	if ok := d.AssertNotCalled(t, "Confirm"); !ok {
+		t.Fatal()
+	}
+
+	if ok := store.AssertNotCalled(t, "Set", mock.Anything); !ok {
+		t.Fatal()
+	}
+}
+
+type redeliveredTestDelivery struct {
+	testDelivery
+	redeliveries int
+}
+
+func (d *redeliveredTestDelivery) Redeliveries() int {
+	return d.redeliveries
+}
+
+func TestHandleDeliverVersionRequeueLimit(t *testing.T) {
+	RegisterNamed("wfe.test.versioned", wfeVersionTest, Version("2"))
+	store := &testStore{}
+	eng := &Engine{store: store, opt: &Options{RequeueVersionMismatch: true, RequeueLimit: 3}}
+
+	d := redeliveredTestDelivery{testDelivery: testDelivery{val: requestImpl{
+		Function:  "wfe.test.versioned",
+		Version:   "1",
+		Arguments: []interface{}{1, 2},
+	}}, redeliveries: 3}
+
+	d.On("ID").Return("1234")
+	d.On("Confirm").Return(nil)
+
+	//no worker took the request in time, it fails instead of being requeued forever
+	store.On("Set", mock.MatchedBy(func(r *Response) bool {
+		return r.State == StateError && strings.Contains(r.Error, ErrVersionMismatch.Error())
+	})).Return(nil)
+
+	err := eng.handleDelivery(&d)
+
+	if ok := assert.True(t, errors.Is(err, ErrVersionMismatch)); !ok {
+		t.Fatal()
+	}
+
+	if ok := d.AssertNotCalled(t, "Requeue"); !ok {
+		t.Fatal()
+	}
+
 	if ok := store.AssertExpectations(t); !ok {
 		t.Fatal()
 	}
 }
+
+func TestRequeueBackoff(t *testing.T) {
+	for _, c := range []struct {
+		redeliveries int
+		backoff      time.Duration
+	}{
+		{0, requeueDelay},
+		{1, 2 * requeueDelay},
+		{3, 8 * requeueDelay},
+		{1000, requeueDelayMax},
+	} {
+		if ok := assert.Equal(t, c.backoff, requeueBackoff(c.redeliveries)); !ok {
+			t.Fatal()
+		}
+	}
+}
+
+func TestHandleDeliverDuplicate(t *testing.T) {
+	Register(wfeTestReturnErr)
+	store := &testStore{}
+	eng := &Engine{store: store}
+
+	d := testDelivery{val: requestImpl{
+		Function:  "github.com/conictus/wfe.wfeTestReturnErr",
+		Key:       "key",
+		Arguments: []interface{}{1},
+	}}
+
+	d.On("ID").Return("1234")
+	d.On("Confirm").Return(nil)
+	store.On("Completed", "1234").Return(true, nil)
+
+	err := eng.handleDelivery(&d)
+
+	if ok := assert.Nil(t, err); !ok {
+		t.Fatal()
+	}
+
+	if ok := d.AssertExpectations(t); !ok {
+		t.Fatal()
+	}
+
+	if ok := store.AssertNotCalled(t, "Set", mock.Anything); !ok {
+		t.Fatal()
+	}
+}
+
+func TestGetRequestsQueuePrefetch(t *testing.T) {
+	for _, queue := range []Queue{
+		{Name: "math", Workers: 10},
+		{Name: "math", Workers: 10, Prefetch: 1},
+		{Name: "math", Workers: 10, Prefetch: -1},
+	} {
+		broker := &testBroker{}
+		consumer := &testConsumer{}
+		deliveries := make(<-chan Delivery)
+
+		prefetch := map[int]int{0: 10, 1: 1, -1: 0}[queue.Prefetch]
+		broker.On("Consumer", &RouteOptions{Queue: "math", Durable: true, Prefetch: prefetch}).Return(consumer, nil)
+		consumer.On("Consume").Return(deliveries, nil)
+
+		eng := &Engine{}
+		requests, err := eng.getRequestsQueue(broker, queue)
+		if ok := assert.Nil(t, err); !ok {
+			t.Fatal()
+		}
+
+		if ok := assert.Equal(t, deliveries, requests); !ok {
+			t.Fatal()
+		}
+
+		if ok := broker.AssertExpectations(t); !ok {
+			t.Fatal()
+		}
+	}
+}
+
+type advertiseTestStore struct {
+	testStore
+	advertised int32
+}
+
+func (s *advertiseTestStore) Advertise(worker string, tasks []TaskInfo) error {
+	atomic.AddInt32(&s.advertised, 1)
+	return nil
+}
+
+func (s *advertiseTestStore) retention() time.Duration {
+	return 20 * time.Millisecond
+}
+
+func TestEngineAdvertiseClose(t *testing.T) {
+	store := &advertiseTestStore{}
+	eng := &Engine{store: store, done: make(chan struct{})}
+
+	eng.advertise()
+	time.Sleep(100 * time.Millisecond)
+
+	//published once, then again every half of the retention
+	if ok := assert.True(t, atomic.LoadInt32(&store.advertised) > 2); !ok {
+		t.Fatal()
+	}
+
+	if ok := assert.Nil(t, eng.Close()); !ok {
+		t.Fatal()
+	}
+
+	//closing twice is fine
+	if ok := assert.Nil(t, eng.Close()); !ok {
+		t.Fatal()
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	advertised := atomic.LoadInt32(&store.advertised)
+	time.Sleep(50 * time.Millisecond)
+	if ok := assert.Equal(t, advertised, atomic.LoadInt32(&store.advertised)); !ok {
+		t.Fatal()
+	}
+}